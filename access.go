@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"strconv"
+)
+
+// userListKey returns the key of the set of users on the "allow" or "deny" list.
+func userListKey(list string) string {
+	return Key("acl", list, "user")
+}
+
+// Permitted reports whether the bot handles the message at all. Admins are always permitted, so that
+// they can lift a restriction from anywhere. If the lists cannot be read, the message is permitted.
+func (req QQMessage) Permitted() bool {
+	if IsAdmin(req.UserId) {
+		return true
+	}
+	userId := strconv.FormatInt(req.UserId, 10)
+	blocked, err := Store.SIsMember(userListKey("deny"), userId)
+	if err != nil {
+		logrus.Error("check deny list fail: ", err)
+	}
+	if blocked {
+		return false
+	}
+	if req.MessageType == "group" {
+		return GroupSettingsOrDefault(req.GroupId).Enabled()
+	}
+	if req.MessageType == "private" && GlobalConfig.Access.PrivateAllowListOnly {
+		allowed, err := Store.SIsMember(userListKey("allow"), userId)
+		if err != nil {
+			logrus.Error("check allow list fail: ", err)
+			return true
+		}
+		return allowed
+	}
+	return true
+}
+
+// ExecuteUserListCommand handles the admin commands "NerdBot block|unblock|allow|disallow <qq>".
+func (req QQMessage) ExecuteUserListCommand(command string, qq string) string {
+	userId, err := strconv.ParseInt(qq, 10, 64)
+	if err != nil || userId <= 0 {
+		return "[错误]用法: NerdBot " + command + " [QQ号]"
+	}
+	if command == "block" && IsAdmin(userId) {
+		return "[错误]不能屏蔽管理员"
+	}
+	qq = strconv.FormatInt(userId, 10)
+	var text string
+	switch command {
+	case "block":
+		err, text = Store.SAdd(userListKey("deny"), qq), "[通知]已屏蔽用户"+qq+"，机器人将忽略其所有消息"
+	case "unblock":
+		err, text = Store.SRem(userListKey("deny"), qq), "[通知]已解除对用户"+qq+"的屏蔽"
+	case "allow":
+		err, text = Store.SAdd(userListKey("allow"), qq), "[通知]已将用户"+qq+"加入私聊白名单"
+	case "disallow":
+		err, text = Store.SRem(userListKey("allow"), qq), "[通知]已将用户"+qq+"移出私聊白名单"
+	}
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]操作失败:存储名单失败"
+	}
+	return text
+}
+
+// ExecuteHereCommand handles the admin commands "NerdBot disable here" and "NerdBot enable here" in a group.
+func (req QQMessage) ExecuteHereCommand(enable bool) string {
+	err := UpdateGroupSettings(strconv.FormatInt(req.GroupId, 10), func(settings *GroupSettings) error {
+		settings.Disabled = !enable
+		if enable {
+			settings.Allowed = true
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]操作失败:存储设置失败"
+	}
+	if enable {
+		return "[通知]机器人已在本群启用"
+	}
+	return "[通知]机器人已在本群停用，管理员可通过NerdBot enable here重新启用"
+}
@@ -0,0 +1,83 @@
+package main
+
+import "unicode"
+
+type acNode struct {
+	children map[rune]int
+	fail     int
+	// lengths (in runes) of the words ending at this node, including those reachable by fail links
+	outputs []int
+}
+
+// AhoCorasick matches a fixed dictionary of words against a text in a single pass, ignoring case.
+type AhoCorasick struct {
+	nodes []acNode
+}
+
+func NewAhoCorasick(words []string) *AhoCorasick {
+	ac := &AhoCorasick{nodes: []acNode{{children: make(map[rune]int)}}}
+	for _, word := range words {
+		runes := []rune(word)
+		if len(runes) == 0 {
+			continue
+		}
+		state := 0
+		for _, r := range runes {
+			r = unicode.ToLower(r)
+			next, ok := ac.nodes[state].children[r]
+			if !ok {
+				ac.nodes = append(ac.nodes, acNode{children: make(map[rune]int)})
+				next = len(ac.nodes) - 1
+				ac.nodes[state].children[r] = next
+			}
+			state = next
+		}
+		ac.nodes[state].outputs = append(ac.nodes[state].outputs, len(runes))
+	}
+	// build fail links breadth first, so that the fail target of a node is always complete
+	queue := make([]int, 0, len(ac.nodes))
+	for _, child := range ac.nodes[0].children {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for r, child := range ac.nodes[state].children {
+			fail := ac.nodes[state].fail
+			for fail != 0 {
+				if _, ok := ac.nodes[fail].children[r]; ok {
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+			if next, ok := ac.nodes[fail].children[r]; ok {
+				ac.nodes[child].fail = next
+			}
+			ac.nodes[child].outputs = append(ac.nodes[child].outputs, ac.nodes[ac.nodes[child].fail].outputs...)
+			queue = append(queue, child)
+		}
+	}
+	return ac
+}
+
+// FindAll returns the [start, end) rune offsets of every dictionary word found in text.
+func (ac *AhoCorasick) FindAll(text []rune) [][2]int {
+	var matches [][2]int
+	state := 0
+	for i, r := range text {
+		r = unicode.ToLower(r)
+		for state != 0 {
+			if _, ok := ac.nodes[state].children[r]; ok {
+				break
+			}
+			state = ac.nodes[state].fail
+		}
+		if next, ok := ac.nodes[state].children[r]; ok {
+			state = next
+		}
+		for _, length := range ac.nodes[state].outputs {
+			matches = append(matches, [2]int{i - length + 1, i + 1})
+		}
+	}
+	return matches
+}
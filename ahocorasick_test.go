@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAhoCorasickFindAll(t *testing.T) {
+	tests := []struct {
+		name  string
+		words []string
+		text  string
+		want  [][2]int
+	}{
+		{"overlapping words", []string{"he", "she", "his", "hers"}, "ushers", [][2]int{{1, 4}, {2, 4}, {2, 6}}},
+		{"ignores case", []string{"Go"}, "GOgo", [][2]int{{0, 2}, {2, 4}}},
+		{"runes", []string{"敏感", "感词"}, "这是敏感词", [][2]int{{2, 4}, {3, 5}}},
+		{"repeated word", []string{"aa"}, "aaa", [][2]int{{0, 2}, {1, 3}}},
+		{"empty word", []string{"", "a"}, "ba", [][2]int{{1, 2}}},
+		{"prefix only", []string{"abc"}, "ab", nil},
+		{"no words", nil, "abc", nil},
+	}
+	for _, tt := range tests {
+		got := NewAhoCorasick(tt.words).FindAll([]rune(tt.text))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: FindAll(%q) = %v, want %v", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// AuditEvent is one line of the audit log. Event is one of "inbound", "ai_request", "ai_response" and "outbound".
+type AuditEvent struct {
+	Time             time.Time `json:"time"`
+	Event            string    `json:"event"`
+	MessageType      string    `json:"messageType,omitempty"`
+	UserId           string    `json:"userId,omitempty"`
+	GroupId          string    `json:"groupId,omitempty"`
+	MessageId        int64     `json:"messageId,omitempty"`
+	Text             string    `json:"text,omitempty"`
+	TextLength       int       `json:"textLength,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int       `json:"promptTokens,omitempty"`
+	CompletionTokens int       `json:"completionTokens,omitempty"`
+	LatencyMs        int64     `json:"latencyMs,omitempty"`
+	Cached           bool      `json:"cached,omitempty"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// AuditLogger appends AuditEvents as JSON lines to a file per day, which is rotated early when it reaches
+// MaxSize, and removes the files older than RetentionDays.
+type AuditLogger struct {
+	mu     sync.Mutex
+	config AuditConfig
+	file   *os.File
+	day    string
+	index  int
+	size   int64
+}
+
+var Auditor *AuditLogger
+
+// auditSaltKey keeps the generated salt of the privacy mode. It is kept apart from the audit directory, as
+// whoever reads the logs together with the salt can recover the ids by trying every QQ number. The key is
+// shared by every bot instance, so that they hash the same id alike.
+const auditSaltKey = "nerdbot:audit:salt"
+
+func InitAudit() error {
+	if !GlobalConfig.Audit.Enable {
+		return nil
+	}
+	err := os.MkdirAll(GlobalConfig.Audit.Directory, 0750)
+	if err != nil {
+		return err
+	}
+	config := GlobalConfig.Audit
+	if config.Privacy && config.HashSalt == "" {
+		config.HashSalt, err = loadOrCreateSalt()
+		if err != nil {
+			return fmt.Errorf("privacy mode needs a hash salt: %w", err)
+		}
+	}
+	Auditor = &AuditLogger{config: config}
+	Auditor.removeExpired(time.Now())
+	return nil
+}
+
+// Audit writes an event to the audit log, if it is enabled. In privacy mode user and group ids are hashed and
+// texts are replaced by their length.
+func Audit(event AuditEvent) {
+	if Auditor == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.TextLength = utf8.RuneCountInString(event.Text)
+	if Auditor.config.Privacy {
+		event.UserId = Auditor.hashId(event.UserId)
+		event.GroupId = Auditor.hashId(event.GroupId)
+		event.Text = ""
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		logrus.Error("[Audit]marshal event fail: ", err)
+		return
+	}
+	err = Auditor.write(append(line, '\n'), event.Time)
+	if err != nil {
+		logrus.Error("[Audit]write event fail: ", err)
+	}
+}
+
+// loadOrCreateSalt reads the salt from the storage, generating a random one on the first run.
+func loadOrCreateSalt() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	created, err := Store.SetNX(auditSaltKey, hex.EncodeToString(random), 0)
+	if err != nil {
+		return "", err
+	}
+	if created {
+		logrus.Info("[Audit]generated the hash salt of the privacy mode in ", auditSaltKey)
+	}
+	return Store.Get(auditSaltKey)
+}
+
+func (a *AuditLogger) hashId(id string) string {
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(a.config.HashSalt + id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (a *AuditLogger) write(line []byte, now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	day := now.Format("20060102")
+	maxSize := int64(a.config.MaxSize) * 1024 * 1024
+	if a.file == nil || day != a.day || (maxSize > 0 && a.size+int64(len(line)) > maxSize) {
+		err := a.rotate(day, now)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate opens the next file of the day, skipping files that are already full after a restart.
+func (a *AuditLogger) rotate(day string, now time.Time) error {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if day != a.day {
+		a.day, a.index = day, 0
+		a.removeExpired(now)
+	} else {
+		a.index++
+	}
+	maxSize := int64(a.config.MaxSize) * 1024 * 1024
+	for {
+		name := filepath.Join(a.config.Directory, fmt.Sprintf("audit-%s-%d.jsonl", a.day, a.index))
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if maxSize > 0 && info.Size() >= maxSize {
+			file.Close()
+			a.index++
+			continue
+		}
+		a.file, a.size = file, info.Size()
+		return nil
+	}
+}
+
+// removeExpired deletes the audit files of the days before the retention limit.
+func (a *AuditLogger) removeExpired(now time.Time) {
+	if a.config.RetentionDays <= 0 {
+		return
+	}
+	oldest := now.AddDate(0, 0, -a.config.RetentionDays).Format("20060102")
+	names, err := filepath.Glob(filepath.Join(a.config.Directory, "audit-*.jsonl"))
+	if err != nil {
+		logrus.Error("[Audit]list audit files fail: ", err)
+		return
+	}
+	for _, name := range names {
+		day := strings.SplitN(strings.TrimPrefix(filepath.Base(name), "audit-"), "-", 2)[0]
+		if day < oldest {
+			if err = os.Remove(name); err != nil {
+				logrus.Error("[Audit]remove expired audit file fail: ", err)
+			}
+		}
+	}
+}
+
+func (a *AuditLogger) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// messageText joins the text segments of a message to be sent.
+func messageText(messages []Message) string {
+	var texts []string
+	for _, message := range messages {
+		if message.Type == "text" {
+			texts = append(texts, fmt.Sprintf("%v", message.Data["text"]))
+		}
+	}
+	return strings.Join(texts, "")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditPrivacy(t *testing.T) {
+	dir := t.TempDir()
+	setTestConfig(t, &Config{Audit: AuditConfig{Enable: true, Directory: dir, Privacy: true}})
+	setTestStore(t)
+	previous := Auditor
+	t.Cleanup(func() {
+		Auditor = previous
+	})
+	if err := InitAudit(); err != nil {
+		t.Fatal(err)
+	}
+	salt := Auditor.config.HashSalt
+	if salt == "" {
+		t.Fatal("no hash salt was generated")
+	}
+	Audit(AuditEvent{Event: "inbound", MessageType: "group", UserId: "10001", GroupId: "20002", Text: "你好"})
+	Auditor.Close()
+	if err := InitAudit(); err != nil {
+		t.Fatal(err)
+	}
+	if Auditor.config.HashSalt != salt {
+		t.Error("the hash salt changed after a restart")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("audit files = %v, want one", files)
+	}
+	line, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event AuditEvent
+	if err = json.Unmarshal(line, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.UserId == "10001" || event.GroupId == "20002" || event.GroupId == "" {
+		t.Errorf("ids were not hashed: user %q, group %q", event.UserId, event.GroupId)
+	}
+	if event.Text != "" || event.TextLength != 2 {
+		t.Errorf("text = %q with length %d, want only the length 2", event.Text, event.TextLength)
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CommandPermission is the permission required to execute a command.
+type CommandPermission int
+
+const (
+	// PermissionUser commands can be executed by everyone, some of them check finer permissions themselves
+	PermissionUser CommandPermission = iota
+	// PermissionAdmin commands can only be executed by admins
+	PermissionAdmin
+)
+
+// CommandScope is the set of chats a command can be used in.
+type CommandScope int
+
+const (
+	ScopePrivate CommandScope = 1 << iota
+	ScopeGroup
+	ScopeAll = ScopePrivate | ScopeGroup
+)
+
+// CommandArg is a positional argument of a command.
+type CommandArg struct {
+	Name     string
+	Required bool
+	// Rest makes the argument take the rest of the command as is, e.g. a prompt or a JSON document
+	Rest bool
+}
+
+// Command is an entry of the command registry.
+type Command struct {
+	// Name may consist of several words, e.g. "group mode"
+	Name    string
+	Aliases []string
+	// Shortcuts are aliases standing for the command with some arguments, e.g. "重置温度" for "set temperature 1"
+	Shortcuts  map[string]string
+	Args       []CommandArg
+	Permission CommandPermission
+	Scope      CommandScope
+	Help       string
+	// Run executes the command and returns the reply. An empty reply means the command has replied by itself.
+	Run func(ctx *CommandContext) string
+}
+
+// CommandContext is what a command runs with.
+type CommandContext struct {
+	Req  QQMessage
+	Args []string
+	// Mode and Id identify the session of the chat, Key is the key of the session, locked while the command runs
+	Mode    string
+	Id      int64
+	Key     string
+	IsAdmin bool
+}
+
+// Arg returns the i-th argument, or "" if it is not given.
+func (ctx *CommandContext) Arg(i int) string {
+	if i < len(ctx.Args) {
+		return ctx.Args[i]
+	}
+	return ""
+}
+
+// commands is the command registry, in the order "NerdBot help" lists them.
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		{
+			Name:    "help",
+			Aliases: []string{"帮助"},
+			Args:    []CommandArg{{Name: "命令", Rest: true}},
+			Scope:   ScopeAll,
+			Help:    "查看可用的命令，或某个命令的用法",
+			Run:     executeHelpCommand,
+		},
+		{
+			Name:    "clear",
+			Aliases: []string{"清除"},
+			Scope:   ScopeAll,
+			Help:    "清除与对话者的所有prompts，重新开始话题",
+			Run: func(ctx *CommandContext) string {
+				DeleteRecord(ctx.Key)
+				return fmt.Sprintf("[通知]ID: %d 的上下文已被清除。", ctx.Id)
+			},
+		},
+		{
+			Name:    "retry",
+			Aliases: []string{"重试"},
+			Args:    []CommandArg{{Name: "temperature"}},
+			Scope:   ScopeAll,
+			Help:    "丢弃上一条AI回复并重新生成，可临时指定更高的temperature，群聊模式下仅管理员可用",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteRetryCommand(ctx.Arg(0), ctx.Key, ctx.Mode, ctx.IsAdmin)
+			},
+		},
+		{
+			Name:    "undo",
+			Aliases: []string{"撤销"},
+			Scope:   ScopeAll,
+			Help:    "撤销上一轮提问与回复，群聊模式下仅管理员可用",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteUndoCommand(ctx.Key, ctx.Mode, ctx.IsAdmin)
+			},
+		},
+		{
+			Name:    "new",
+			Aliases: []string{"新对话"},
+			Args:    []CommandArg{{Name: "标题", Rest: true}},
+			Scope:   ScopeAll,
+			Help:    "新建一个对话并切换过去，原对话的上下文会被保留",
+			Run:     executeConversationCommand("new"),
+		},
+		{
+			Name:    "list",
+			Aliases: []string{"对话列表"},
+			Scope:   ScopeAll,
+			Help:    "查看对话列表",
+			Run:     executeConversationCommand("list"),
+		},
+		{
+			Name:  "switch",
+			Args:  []CommandArg{{Name: "编号", Required: true}},
+			Scope: ScopeAll,
+			Help:  "切换到对话列表中的对话，群聊模式下仅管理员可用",
+			Run:   executeConversationCommand("switch"),
+		},
+		{
+			Name:  "delete",
+			Args:  []CommandArg{{Name: "编号", Required: true}},
+			Scope: ScopeAll,
+			Help:  "删除对话列表中的对话，群聊模式下仅管理员可用",
+			Run:   executeConversationCommand("delete"),
+		},
+		{
+			Name:    "export",
+			Aliases: []string{"导出"},
+			Args:    []CommandArg{{Name: "md|json"}},
+			Scope:   ScopeAll,
+			Help:    "将当前对话导出为Markdown或JSON文件(或合并转发消息)发送",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteExportCommand(ctx.Arg(0), ctx.Key)
+			},
+		},
+		{
+			Name:    "settings",
+			Aliases: []string{"设置"},
+			Scope:   ScopeAll,
+			Help:    "查看当前会话生效的model、temperature等参数",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteSettingsCommand(ctx.Key)
+			},
+		},
+		{
+			Name:  "set",
+			Args:  []CommandArg{{Name: "参数", Required: true}, {Name: "值", Required: true, Rest: true}},
+			Scope: ScopeAll,
+			Help:  "修改会话参数(" + strings.Join(SessionParams, ", ") + ")，非管理员仅可修改配置项userSettableParams中列出的参数",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteSetCommand(ctx.Arg(0), ctx.Arg(1), ctx.Key, ctx.IsAdmin)
+			},
+		},
+		{
+			Name:    "persona",
+			Aliases: []string{"人格"},
+			Args:    []CommandArg{{Name: "list|show|use|set|delete", Required: true}, {Name: "名称"}, {Name: "prompts", Rest: true}},
+			Scope:   ScopeAll,
+			Help:    "查看人格预设/当前人格，切换当前会话的人格(群聊中仅管理员可用)，或修改人格预设(仅管理员可用)",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecutePersonaCommand(ctx.Args, ctx.Key, ctx.IsAdmin)
+			},
+		},
+		{
+			Name:    "usage",
+			Aliases: []string{"用量"},
+			Args:    []CommandArg{{Name: "top|group"}, {Name: "群号|month"}, {Name: "month"}},
+			Scope:   ScopeAll,
+			Help:    "查看自己今日及本月的token用量与估算费用，top与group仅管理员可用",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteUsageCommand(ctx.Args, ctx.IsAdmin)
+			},
+		},
+		{
+			Name:       "kb",
+			Aliases:    []string{"知识库"},
+			Args:       []CommandArg{{Name: "add|load|clear|stats", Required: true}, {Name: "文本", Rest: true}},
+			Permission: PermissionAdmin,
+			Scope:      ScopeGroup,
+			Help:       "向本群知识库添加文本/从知识库目录导入本群文档/清空本群知识库/查看分块数量",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteKnowledgeCommand(ctx.Args)
+			},
+		},
+		{
+			Name:       "import",
+			Aliases:    []string{"导入"},
+			Args:       []CommandArg{{Name: "JSON", Required: true, Rest: true}},
+			Permission: PermissionAdmin,
+			Scope:      ScopeAll,
+			Help:       "将export json导出的内容导入为新的对话",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteImportCommand(ctx.Arg(0), ctx.Key)
+			},
+		},
+		{
+			Name:       "group mode",
+			Aliases:    []string{"群聊模式"},
+			Permission: PermissionAdmin,
+			Scope:      ScopeGroup,
+			Help:       "开启群聊模式，即记录所有群聊信息到prompts内，会消耗大量tokens",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteGroupModeCommand(true)
+			},
+		},
+		{
+			Name:       "private mode",
+			Aliases:    []string{"私聊模式"},
+			Permission: PermissionAdmin,
+			Scope:      ScopeGroup,
+			Help:       "关闭群聊模式，恢复单对单的有上下文的对话",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteGroupModeCommand(false)
+			},
+		},
+		{
+			Name:       "group",
+			Args:       []CommandArg{{Name: "settings|quota|trigger"}, {Name: "每日tokens|reset|add|remove"}, {Name: "每月tokens|正则表达式"}},
+			Permission: PermissionAdmin,
+			Scope:      ScopeGroup,
+			Help:       "查看本群的设置，设置本群的额度，或添加/删除本群的触发词(含空格的正则表达式需加引号)",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteGroupCommand(ctx.Args)
+			},
+		},
+		{
+			Name:       "disable here",
+			Permission: PermissionAdmin,
+			Scope:      ScopeGroup,
+			Help:       "在本群停用机器人，停用后仅响应管理员命令",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteHereCommand(false)
+			},
+		},
+		{
+			Name:       "enable here",
+			Permission: PermissionAdmin,
+			Scope:      ScopeGroup,
+			Help:       "在本群启用机器人",
+			Run: func(ctx *CommandContext) string {
+				return ctx.Req.ExecuteHereCommand(true)
+			},
+		},
+		userListCommand("block", "屏蔽用户，被屏蔽用户的所有消息都会被忽略"),
+		userListCommand("unblock", "解除对用户的屏蔽"),
+		userListCommand("allow", "将用户加入私聊白名单，配置项access.privateAllowListOnly开启时私聊只回复白名单用户"),
+		userListCommand("disallow", "将用户移出私聊白名单"),
+	}
+}
+
+func executeConversationCommand(command string) func(ctx *CommandContext) string {
+	return func(ctx *CommandContext) string {
+		return ctx.Req.ExecuteConversationCommand(command, ctx.Arg(0), ctx.Key, ctx.Mode == "group", ctx.IsAdmin)
+	}
+}
+
+func userListCommand(command string, help string) *Command {
+	return &Command{
+		Name:       command,
+		Args:       []CommandArg{{Name: "QQ号", Required: true}},
+		Permission: PermissionAdmin,
+		Scope:      ScopeAll,
+		Help:       help,
+		Run: func(ctx *CommandContext) string {
+			return ctx.Req.ExecuteUserListCommand(command, ctx.Arg(0))
+		},
+	}
+}
+
+// InitCommandAliases merges the aliases of command.aliases into the registry, so that they are found, listed
+// by help and suggested like the built-in ones. An alias standing for a command with arguments becomes a
+// shortcut of the command. {nickname} in an alias is replaced by the bot's nickname like in the command prefixes,
+// so the aliases are initiated once the login info is known.
+func InitCommandAliases() error {
+	aliases := make([]string, 0, len(GlobalConfig.Command.Aliases))
+	for alias := range GlobalConfig.Command.Aliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, name := range aliases {
+		target := GlobalConfig.Command.Aliases[name]
+		alias, _, ok := expandCommandPrefix(name)
+		if !ok {
+			logrus.Warningf("command alias %q is ignored: the nickname of the bot is unknown", name)
+			continue
+		}
+		if strings.TrimSpace(alias) != alias || alias == "" {
+			return fmt.Errorf("invalid command alias %q", name)
+		}
+		if c, rest := FindCommand(alias); c != nil && rest == "" {
+			return fmt.Errorf("command alias %q is already used by command %q", alias, c.Name)
+		}
+		c, args := FindCommand(strings.TrimSpace(target))
+		if c == nil {
+			return fmt.Errorf("command alias %q: unknown command %q", alias, target)
+		}
+		if args == "" {
+			c.Aliases = append(c.Aliases, alias)
+			continue
+		}
+		if c.Shortcuts == nil {
+			c.Shortcuts = make(map[string]string)
+		}
+		c.Shortcuts[alias] = args
+	}
+	return nil
+}
+
+// names returns the name, the aliases and the shortcuts of the command.
+func (c *Command) names() []string {
+	names := append([]string{c.Name}, c.Aliases...)
+	shortcuts := make([]string, 0, len(c.Shortcuts))
+	for shortcut := range c.Shortcuts {
+		shortcuts = append(shortcuts, shortcut)
+	}
+	sort.Strings(shortcuts)
+	return append(names, shortcuts...)
+}
+
+// commandPrefix returns the prefix shown in usages and help, i.e. the first configured one.
+func commandPrefix() string {
+	if prefixes := commandPrefixes(); len(prefixes) > 0 {
+		return prefixes[0]
+	}
+	return ""
+}
+
+// Usage returns the usage of the command, e.g. "NerdBot switch <编号>".
+func (c *Command) Usage() string {
+	usage := commandPrefix() + c.Name
+	for _, arg := range c.Args {
+		if arg.Required {
+			usage += " <" + arg.Name + ">"
+		} else {
+			usage += " [" + arg.Name + "]"
+		}
+	}
+	return usage
+}
+
+// Text returns the detailed help of the command for "NerdBot help <command>".
+func (c *Command) Text() string {
+	text := "[通知]用法: " + c.Usage() + "\n" + c.Help
+	if len(c.Aliases) > 0 {
+		text += "\n别名: " + strings.Join(c.Aliases, ", ")
+	}
+	for _, name := range c.names()[1+len(c.Aliases):] {
+		text += "\n快捷方式: " + name + " = " + c.Name + " " + c.Shortcuts[name]
+	}
+	if c.Permission == PermissionAdmin {
+		text += "\n仅管理员可用"
+	}
+	switch c.Scope {
+	case ScopePrivate:
+		text += "\n仅可在私聊中使用"
+	case ScopeGroup:
+		text += "\n仅可在群聊中使用"
+	}
+	return text
+}
+
+// Check returns the error shown to the user if the command cannot be used in the chat of req.
+func (c *Command) Check(req QQMessage, isAdmin bool) (string, bool) {
+	if req.MessageType == "group" && c.Scope&ScopeGroup == 0 {
+		return "[错误]该命令只能在私聊中使用", false
+	}
+	if req.MessageType != "group" && c.Scope&ScopePrivate == 0 {
+		return "[错误]该命令只能在群聊中使用", false
+	}
+	if c.Permission == PermissionAdmin && !isAdmin {
+		return "[错误]\n对不起，您没有权限执行该命令", false
+	}
+	return "", true
+}
+
+// FindCommand returns the command whose name, alias or shortcut is the longest one text starts with, and the
+// arguments after it. The arguments of a shortcut come before the ones given.
+func FindCommand(text string) (*Command, string) {
+	var found *Command
+	var foundName string
+	for _, c := range commands {
+		for _, name := range c.names() {
+			if len(name) <= len(foundName) || !strings.HasPrefix(text, name) {
+				continue
+			}
+			if next, _ := utf8.DecodeRuneInString(text[len(name):]); len(text) == len(name) || unicode.IsSpace(next) {
+				found, foundName = c, name
+			}
+		}
+	}
+	if found == nil {
+		return nil, ""
+	}
+	args := strings.TrimLeftFunc(text[len(foundName):], unicode.IsSpace)
+	if shortcut, ok := found.Shortcuts[foundName]; ok {
+		args = strings.TrimRightFunc(shortcut+" "+args, unicode.IsSpace)
+	}
+	return found, args
+}
+
+// closingQuotes maps the quotes an argument can be quoted with to the quotes closing it.
+var closingQuotes = map[rune]rune{'"': '"', '\'': '\'', '“': '”', '‘': '’'}
+
+// nextArg splits text, which starts with no space, into its first argument and the text after it.
+func nextArg(text string) (string, string, error) {
+	if quote, size := utf8.DecodeRuneInString(text); closingQuotes[quote] != 0 {
+		end := strings.IndexRune(text[size:], closingQuotes[quote])
+		if end < 0 {
+			return "", "", fmt.Errorf("引号%c未闭合", quote)
+		}
+		rest := text[size+end+utf8.RuneLen(closingQuotes[quote]):]
+		return text[size : size+end], strings.TrimLeftFunc(rest, unicode.IsSpace), nil
+	}
+	end := strings.IndexFunc(text, unicode.IsSpace)
+	if end < 0 {
+		return text, "", nil
+	}
+	return text[:end], strings.TrimLeftFunc(text[end:], unicode.IsSpace), nil
+}
+
+// ParseCommandArgs splits text into the arguments of schema. Arguments are separated by spaces and may be
+// quoted with double, single or Chinese quotes to contain spaces. An argument with Rest takes the rest of
+// text as is, without the quotes if the rest is quoted as a whole.
+func ParseCommandArgs(schema []CommandArg, text string) ([]string, error) {
+	args := make([]string, 0, len(schema))
+	rest := strings.TrimSpace(text)
+	for _, arg := range schema {
+		if rest == "" {
+			if arg.Required {
+				return nil, errors.New("缺少参数" + arg.Name)
+			}
+			continue
+		}
+		if arg.Rest {
+			if quoted, remain, err := nextArg(rest); err == nil && remain == "" {
+				rest = quoted
+			}
+			args = append(args, rest)
+			rest = ""
+			continue
+		}
+		value, remain, err := nextArg(rest)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+		rest = remain
+	}
+	if rest != "" {
+		return nil, errors.New("参数过多: " + rest)
+	}
+	return args, nil
+}
+
+// editDistance returns the Levenshtein distance of a and b, counting a swap of adjacent characters as one edit.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+// maxSuggestions is the number of close matches suggested for a mistyped command.
+const maxSuggestions = 3
+
+// SuggestCommands returns the names and aliases closest to the mistyped command text, among the commands
+// that can be used in the chat of req.
+func SuggestCommands(text string, req QQMessage, isAdmin bool) []string {
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	words := strings.Fields(text)
+	var suggestions []suggestion
+	for _, c := range commands {
+		if _, ok := c.Check(req, isAdmin); !ok {
+			continue
+		}
+		for _, name := range c.names() {
+			n := len(strings.Fields(name))
+			if n > len(words) {
+				continue
+			}
+			// short names tolerate a single typo, otherwise nearly every short word would match
+			maxDistance := 1
+			if utf8.RuneCountInString(name) > 4 {
+				maxDistance = 2
+			}
+			if distance := editDistance(strings.Join(words[:n], " "), name); distance <= maxDistance {
+				suggestions = append(suggestions, suggestion{name: name, distance: distance})
+			}
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].distance < suggestions[j].distance
+	})
+	names := make([]string, 0, maxSuggestions)
+	for _, s := range suggestions {
+		if len(names) == maxSuggestions {
+			break
+		}
+		names = append(names, commandPrefix()+s.name)
+	}
+	return names
+}
+
+// unknownCommandText returns the reply to an unknown command, suggesting close matches if there are any.
+func unknownCommandText(text string, req QQMessage, isAdmin bool) string {
+	reply := "[错误]未查询到相应指令"
+	if fields := strings.Fields(text); len(fields) > 0 {
+		reply += ": " + fields[0]
+	}
+	if suggestions := SuggestCommands(text, req, isAdmin); len(suggestions) > 0 {
+		reply += "\n您是不是想输入: " + strings.Join(suggestions, "、")
+	}
+	return reply + "\n发送 " + commandPrefix() + "help 查看可用的命令"
+}
+
+// executeHelpCommand handles "NerdBot help [command]".
+func executeHelpCommand(ctx *CommandContext) string {
+	if name := ctx.Arg(0); name != "" {
+		c, _ := FindCommand(name)
+		if c == nil {
+			return unknownCommandText(name, ctx.Req, ctx.IsAdmin)
+		}
+		return c.Text()
+	}
+	text := "[通知]可用的命令:"
+	for _, c := range commands {
+		if _, ok := c.Check(ctx.Req, ctx.IsAdmin); ok {
+			text += "\n" + c.Usage() + " - " + c.Help
+		}
+	}
+	return text + "\n发送 " + commandPrefix() + "help [命令] 查看命令的详细用法"
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// setTestCommands makes the changes of a test to the command registry, e.g. by InitCommandAliases, undone
+// when the test ends.
+func setTestCommands(t *testing.T) {
+	t.Helper()
+	previous := commands
+	commands = make([]*Command, 0, len(previous))
+	for _, c := range previous {
+		clone := *c
+		clone.Aliases = append([]string(nil), c.Aliases...)
+		clone.Shortcuts = nil
+		for name, args := range c.Shortcuts {
+			if clone.Shortcuts == nil {
+				clone.Shortcuts = make(map[string]string)
+			}
+			clone.Shortcuts[name] = args
+		}
+		commands = append(commands, &clone)
+	}
+	t.Cleanup(func() {
+		commands = previous
+	})
+}
+
+func TestParseCommandArgs(t *testing.T) {
+	two := []CommandArg{{Name: "a", Required: true}, {Name: "b"}}
+	rest := []CommandArg{{Name: "a", Required: true}, {Name: "b", Rest: true}}
+	tests := []struct {
+		name    string
+		schema  []CommandArg
+		text    string
+		want    []string
+		wantErr bool
+	}{
+		{"plain", two, "x y", []string{"x", "y"}, false},
+		{"extra spaces", two, "  x   y ", []string{"x", "y"}, false},
+		{"optional missing", two, "x", []string{"x"}, false},
+		{"double quotes", two, `"x y" z`, []string{"x y", "z"}, false},
+		{"single quotes", two, `x 'y z'`, []string{"x", "y z"}, false},
+		{"chinese quotes", two, "“你 好” 世界", []string{"你 好", "世界"}, false},
+		{"unclosed quote", two, `"x y`, nil, true},
+		{"required missing", two, "", nil, true},
+		{"too many", two, "x y z", nil, true},
+		{"rest", rest, "x y  z", []string{"x", "y  z"}, false},
+		{"rest quoted as a whole", rest, `x "y z"`, []string{"x", "y z"}, false},
+		{"rest quoted in part", rest, `x "y" z`, []string{"x", `"y" z`}, false},
+		{"rest with unclosed quote", rest, `x "y z`, []string{"x", `"y z`}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseCommandArgs(tt.schema, tt.text)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseCommandArgs(%q) = %q, %v, want %q, error %v", tt.name, tt.text, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	setTestConfig(t, &Config{OneBot11: OneBot11Config{SelfNickname: "小书"}, Command: CommandConfig{
+		Prefixes: []string{"/"},
+		Aliases:  map[string]string{"清空": "clear", "群模式": "group mode", "重置温度": "set temperature 1", "{nickname}清除": "clear"},
+	}})
+	setTestCommands(t)
+	if err := InitCommandAliases(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		text string
+		name string
+		args string
+	}{
+		{"clear", "clear", ""},
+		{"清除", "clear", ""},
+		{"清空", "clear", ""},
+		{"help  retry", "help", "retry"},
+		{"group mode", "group mode", ""},
+		{"group settings", "group", "settings"},
+		{"群模式", "group mode", ""},
+		{"重置温度", "set", "temperature 1"},
+		{"重置温度 x", "set", "temperature 1 x"},
+		{"小书清除", "clear", ""},
+		{"{nickname}清除", "", ""},
+		{"clearx", "", ""},
+		{"unknown", "", ""},
+	}
+	for _, tt := range tests {
+		c, args := FindCommand(tt.text)
+		name := ""
+		if c != nil {
+			name = c.Name
+		}
+		if name != tt.name || args != tt.args {
+			t.Errorf("FindCommand(%q) = %q, %q, want %q, %q", tt.text, name, args, tt.name, tt.args)
+		}
+	}
+}
+
+func TestInitCommandAliasesErrors(t *testing.T) {
+	for _, aliases := range []map[string]string{
+		{"x": "unknown"},
+		{"帮助": "clear"},
+		{" x": "clear"},
+		{"": "clear"},
+	} {
+		setTestConfig(t, &Config{Command: CommandConfig{Aliases: aliases}})
+		setTestCommands(t)
+		if err := InitCommandAliases(); err == nil {
+			t.Errorf("InitCommandAliases(%q) error = nil", aliases)
+		}
+	}
+}
+
+func TestInitCommandAliasesWithoutNickname(t *testing.T) {
+	setTestConfig(t, &Config{Command: CommandConfig{Aliases: map[string]string{"{nickname}清除": "clear"}}})
+	setTestCommands(t)
+	if err := InitCommandAliases(); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := FindCommand("{nickname}清除"); c != nil {
+		t.Errorf("FindCommand(%q) = %q, want nil", "{nickname}清除", c.Name)
+	}
+}
+
+func TestSuggestCommands(t *testing.T) {
+	setTestConfig(t, &Config{Command: CommandConfig{Prefixes: []string{"/"}}})
+	private := QQMessage{MessageType: "private"}
+	group := QQMessage{MessageType: "group"}
+	tests := []struct {
+		text    string
+		req     QQMessage
+		isAdmin bool
+		want    []string
+	}{
+		{"claer", private, false, []string{"/clear"}},
+		{"retyr 0.5", private, false, []string{"/retry"}},
+		{"hepl", private, false, []string{"/help"}},
+		{"清楚", private, false, []string{"/清除"}},
+		{"gruop mode", group, true, []string{"/group mode", "/group"}},
+		{"gruop mode", group, false, []string{}},
+		{"gruop mode", private, true, []string{}},
+		{"xyzzy", private, false, []string{}},
+	}
+	for _, tt := range tests {
+		if got := SuggestCommands(tt.text, tt.req, tt.isAdmin); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SuggestCommands(%q, %s, admin %v) = %q, want %q", tt.text, tt.req.MessageType, tt.isAdmin, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"clear", "clear", 0},
+		{"claer", "clear", 1},
+		{"clea", "clear", 1},
+		{"cler", "clear", 1},
+		{"xlear", "clear", 1},
+		{"清楚", "清除", 1},
+		{"", "new", 3},
+		{"abc", "cba", 2},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -10,20 +10,43 @@ type OneBot11Config struct {
 	AccessToken      string `yaml:"accessToken"`
 	ServerUrl        string `yaml:"serverUrl"`
 	SelfId           int64  `yaml:"-"`
+	SelfNickname     string `yaml:"-"`
 	HeartbeatTimeOut int    `yaml:"heartbeatTimeOut" comment:"heartbeat的超时时间"`
 }
 
+type ModelEndpoint struct {
+	Model     string `yaml:"model"`
+	ChatAIUrl string `yaml:"chatAIUrl" comment:"为空时使用openAI.chatAIUrl"`
+	APIKey    string `yaml:"APIKey" comment:"为空时使用openAI.APIKey"`
+}
+
+type Persona struct {
+	Prompt      string   `yaml:"prompt" json:"prompt" comment:"人格的系统prompts"`
+	Model       string   `yaml:"model" json:"model,omitempty" comment:"为空时使用openAI.model"`
+	Temperature *float64 `yaml:"temperature" json:"temperature,omitempty" comment:"为空时使用openAI.defaultTemperature"`
+}
+
 type OpenAIConfig struct {
-	ChatAIUrl            string         `yaml:"chatAIUrl" comment:"调用API的URL"`
-	APIKey               string         `yaml:"APIKey"`
-	Model                string         `yaml:"model"`
-	ResponseMaxTokens    int            `yaml:"responseMaxTokens" comment:"AI回复内容的最大token数量"`
-	GroupChatMaxTokens   int            `yaml:"groupChatMaxTokens" comment:"群聊模式下全部prompts的最大token数量"`
-	PrivateChatMaxTokens int            `yaml:"privateChatMaxTokens" comment:"非群聊模式下全部prompts的最大token数量"`
-	EnableGroupChat      map[int64]bool `yaml:"-"`
-	DefaultTemperature   float64        `yaml:"defaultTemperature"`
-	InitialPrompts       string         `yaml:"initialPrompts" comment:"初始化AI设定的prompts"`
-	MinInterval          float64        `yaml:"minInterval" comment:"最短API调用间隔"`
+	ChatAIUrl            string             `yaml:"chatAIUrl" comment:"调用API的URL"`
+	APIKey               string             `yaml:"APIKey"`
+	Model                string             `yaml:"model"`
+	FallbackChain        []ModelEndpoint    `yaml:"fallbackChain" comment:"主模型限流、超时、5xx或上下文超长时依次尝试的备用模型，回复末尾会注明所用的备用模型，该说明仅用于显示，不会保存到上下文与导出中"`
+	RequestTimeout       int                `yaml:"requestTimeout" comment:"单次API调用的超时时间(秒)"`
+	EmbeddingUrl         string             `yaml:"embeddingUrl" comment:"embeddings接口的URL"`
+	EmbeddingModel       string             `yaml:"embeddingModel"`
+	AllowedModels        []string           `yaml:"allowedModels" comment:"可通过set model切换的模型"`
+	UserSettableParams   []string           `yaml:"userSettableParams" comment:"非管理员也可通过set命令修改的参数，如temperature、top_p"`
+	ResponseMaxTokens    int                `yaml:"responseMaxTokens" comment:"AI回复内容的最大token数量"`
+	GroupChatMaxTokens   int                `yaml:"groupChatMaxTokens" comment:"群聊模式下全部prompts的最大token数量"`
+	PrivateChatMaxTokens int                `yaml:"privateChatMaxTokens" comment:"非群聊模式下全部prompts的最大token数量"`
+	DefaultTemperature   float64            `yaml:"defaultTemperature"`
+	InitialPrompts       string             `yaml:"initialPrompts" comment:"初始化AI设定的prompts，支持{{.Now}}、{{.GroupName}}、{{.UserNickname}}、{{.BotName}}、{{.MemberCount}}等模板变量"`
+	Personas             map[string]Persona `yaml:"personas" comment:"人格预设，可通过persona use切换"`
+}
+
+type StorageConfig struct {
+	Backend string `yaml:"backend" comment:"存储后端: redis，memory(仅保存在内存中，退出后丢失)，file(单文件数据库，无需安装redis)"`
+	File    string `yaml:"file" comment:"backend为file时的数据库文件路径"`
 }
 
 type RedisConfig struct {
@@ -40,6 +63,7 @@ type GreetingConfig struct {
 type ServerConfig struct {
 	Address  string  `yaml:"address"`
 	AdminIds []int64 `yaml:"adminIds" comment:"管理员帐号ID"`
+	Metrics  bool    `yaml:"metrics" comment:"是否提供GET /metrics消息队列统计，设置了OneBot的accessToken时需要携带同样的token访问"`
 }
 
 type OpenWechatConfig struct {
@@ -49,15 +73,137 @@ type OpenWechatConfig struct {
 	EncodingAESKey string `yaml:"encoding_aes_key"`
 }
 
+type ModerationConfig struct {
+	Enable           bool   `yaml:"enable"`
+	DictionaryFile   string `yaml:"dictionaryFile" comment:"敏感词词典文件，每行一个词"`
+	EnableOpenAI     bool   `yaml:"enableOpenAI" comment:"是否同时调用OpenAI moderations接口"`
+	ModerationUrl    string `yaml:"moderationUrl"`
+	InputAction      string `yaml:"inputAction" comment:"用户消息命中时的处理方式: refuse|mask|notify"`
+	OutputAction     string `yaml:"outputAction" comment:"AI回复命中时的处理方式: refuse|mask|notify"`
+	NotifyAdmins     bool   `yaml:"notifyAdmins" comment:"refuse或mask时是否同时私聊通知管理员"`
+	RefuseMessage    string `yaml:"refuseMessage"`
+	BlockedReplyText string `yaml:"blockedReplyText" comment:"AI回复被拦截时发送的内容"`
+}
+
+type ResponseCacheConfig struct {
+	Enable              bool    `yaml:"enable"`
+	TTL                 int     `yaml:"ttl" comment:"缓存有效期(秒)"`
+	EnableEmbedding     bool    `yaml:"enableEmbedding" comment:"精确匹配未命中时是否按embedding相似度查找"`
+	SimilarityThreshold float64 `yaml:"similarityThreshold" comment:"相似度阈值，0~1"`
+	MaxEntries          int64   `yaml:"maxEntries" comment:"相同模型、系统提示词及群聊下参与相似度查找的最大缓存数"`
+}
+
+type KnowledgeBaseConfig struct {
+	Enable        bool    `yaml:"enable"`
+	Directory     string  `yaml:"directory" comment:"知识库文档目录，其下以群号命名的子目录中的.md/.txt文件会导入该群的知识库"`
+	ChunkSize     int     `yaml:"chunkSize" comment:"分块的最大字符数"`
+	ChunkOverlap  int     `yaml:"chunkOverlap" comment:"超长段落分块时相邻块重叠的字符数"`
+	TopK          int     `yaml:"topK" comment:"每次对话注入的最大分块数"`
+	MinSimilarity float64 `yaml:"minSimilarity" comment:"注入分块的最低相似度，0~1"`
+}
+
+type ModelPrice struct {
+	Prompt     float64 `yaml:"prompt" comment:"每1000个prompt token的价格"`
+	Completion float64 `yaml:"completion" comment:"每1000个completion token的价格"`
+}
+
+type UsageConfig struct {
+	Currency      string                `yaml:"currency"`
+	Prices        map[string]ModelPrice `yaml:"prices" comment:"各模型的价格表，用于估算费用"`
+	RetentionDays int                   `yaml:"retentionDays" comment:"用量统计的保留天数"`
+}
+
+type QuotaLimit struct {
+	DailyTokens   int64   `yaml:"dailyTokens" comment:"每日token上限，0表示不限制"`
+	MonthlyTokens int64   `yaml:"monthlyTokens" comment:"每月token上限，0表示不限制"`
+	DailyCost     float64 `yaml:"dailyCost" comment:"每日费用上限，0表示不限制"`
+	MonthlyCost   float64 `yaml:"monthlyCost" comment:"每月费用上限，0表示不限制"`
+}
+
+type QuotaConfig struct {
+	User   QuotaLimit `yaml:"user" comment:"每个用户的额度"`
+	Group  QuotaLimit `yaml:"group" comment:"每个群的额度"`
+	Global QuotaLimit `yaml:"global" comment:"机器人整体的额度"`
+}
+
+type BucketLimit struct {
+	Rate  float64 `yaml:"rate" comment:"每秒补充的调用次数，0表示不限制"`
+	Burst int     `yaml:"burst" comment:"最多可连续调用的次数"`
+}
+
+type RateLimitConfig struct {
+	User          BucketLimit `yaml:"user" comment:"每个用户的AI调用频率"`
+	Group         BucketLimit `yaml:"group" comment:"每个群的AI调用频率"`
+	Global        BucketLimit `yaml:"global" comment:"机器人整体的AI调用频率"`
+	RejectAction  string      `yaml:"rejectAction" comment:"超出频率时的处理: silent直接忽略，warn每个限流窗口提示一次"`
+	RejectMessage string      `yaml:"rejectMessage"`
+}
+
+type EventQueueConfig struct {
+	Workers      int    `yaml:"workers" comment:"处理消息的worker数量，同一会话的消息总由同一个worker按顺序处理"`
+	QueueSize    int    `yaml:"queueSize" comment:"每个worker的队列长度"`
+	Overflow     string `yaml:"overflow" comment:"队列已满时的处理: drop直接丢弃，block等待blockTimeout秒后仍满则丢弃"`
+	BlockTimeout int    `yaml:"blockTimeout" comment:"overflow为block时的最长等待时间(秒)"`
+}
+
+type AuditConfig struct {
+	Enable        bool   `yaml:"enable" comment:"记录收到的消息、AI请求与回复、发送的消息，用于调查投诉"`
+	Directory     string `yaml:"directory" comment:"审计日志目录，每天一个JSONL文件"`
+	MaxSize       int    `yaml:"maxSize" comment:"单个文件的最大大小(MB)，超过后提前轮转，0表示不限制"`
+	RetentionDays int    `yaml:"retentionDays" comment:"审计日志的保留天数，0表示永久保留"`
+	Privacy       bool   `yaml:"privacy" comment:"隐私模式: 用户ID和群号以哈希记录，消息内容只记录长度"`
+	HashSalt      string `yaml:"hashSalt" comment:"隐私模式下哈希用户ID和群号所用的盐，为空时自动生成并保存在存储中，memory存储重启后会重新生成"`
+}
+
+type AccessConfig struct {
+	PrivateAllowListOnly bool `yaml:"privateAllowListOnly" comment:"私聊只回复白名单中的用户，通过allow/disallow命令管理"`
+	GroupAllowListOnly   bool `yaml:"groupAllowListOnly" comment:"只在通过enable here开启的群中回复"`
+}
+
+type CommandConfig struct {
+	Prefixes      []string          `yaml:"prefixes" comment:"命令前缀，如\"NerdBot \"、\"/\"、\"#\"，{nickname}表示机器人的昵称"`
+	Aliases       map[string]string `yaml:"aliases" comment:"额外的命令别名，如 清空: clear，也可带参数，如 重置温度: set temperature 1，别名中的{nickname}会替换为机器人昵称，内置的别名可通过help命令查看"`
+	TriggerOnName bool              `yaml:"triggerOnName" comment:"群消息中提到机器人的昵称时视为@机器人"`
+	Triggers      []string          `yaml:"triggers" comment:"群消息匹配这些正则表达式时视为@机器人"`
+}
+
+type ExportConfig struct {
+	Mode      string `yaml:"mode" comment:"导出方式: file以群文件/私聊文件发送，forward以合并转发消息发送"`
+	Directory string `yaml:"directory" comment:"导出文件的临时保存目录，需要能被OneBot实现访问，上传后文件即被删除"`
+}
+
+type RetentionPolicy struct {
+	IdleTTL    int    `yaml:"idleTTL" comment:"会话闲置多久后过期(秒)，0表示不过期"`
+	DailyReset string `yaml:"dailyReset" comment:"每日清空会话的时间，格式为HH:MM，为空表示不清空"`
+}
+
+type RetentionConfig struct {
+	Private RetentionPolicy `yaml:"private" comment:"1 vs 1 对话的保留策略"`
+	Group   RetentionPolicy `yaml:"group" comment:"群聊模式会话的保留策略"`
+}
+
 type Config struct {
-	Server     ServerConfig     `yaml:"server"`
-	OneBot11   OneBot11Config   `yaml:"oneBot11"`
-	AI         OpenAIConfig     `yaml:"openAI"`
-	Redis      RedisConfig      `yaml:"redis"`
-	Greeting   GreetingConfig   `yaml:"greeting"`
-	OpenWechat OpenWechatConfig `yaml:"open_wechat"`
-	ServeMode  string           `yaml:"serve_mode"`
-	Debug      bool             `yaml:"debug"`
+	Server     ServerConfig        `yaml:"server"`
+	OneBot11   OneBot11Config      `yaml:"oneBot11"`
+	AI         OpenAIConfig        `yaml:"openAI"`
+	Storage    StorageConfig       `yaml:"storage"`
+	Redis      RedisConfig         `yaml:"redis"`
+	Greeting   GreetingConfig      `yaml:"greeting"`
+	Moderation ModerationConfig    `yaml:"moderation"`
+	Cache      ResponseCacheConfig `yaml:"responseCache"`
+	Knowledge  KnowledgeBaseConfig `yaml:"knowledgeBase"`
+	Usage      UsageConfig         `yaml:"usage"`
+	Quota      QuotaConfig         `yaml:"quota"`
+	RateLimit  RateLimitConfig     `yaml:"rateLimit"`
+	EventQueue EventQueueConfig    `yaml:"eventQueue"`
+	Audit      AuditConfig         `yaml:"audit"`
+	Access     AccessConfig        `yaml:"access"`
+	Command    CommandConfig       `yaml:"command"`
+	Export     ExportConfig        `yaml:"export"`
+	Retention  RetentionConfig     `yaml:"retention"`
+	OpenWechat OpenWechatConfig    `yaml:"open_wechat"`
+	ServeMode  string              `yaml:"serve_mode"`
+	Debug      bool                `yaml:"debug"`
 }
 
 var GlobalConfig *Config
@@ -85,18 +231,107 @@ func InitGlobalConfig() error {
 			ChatAIUrl:            "https://api.openai.com/v1/completions",
 			APIKey:               "YOUR_API_KEY",
 			Model:                "gpt-3.5-turbo",
+			FallbackChain:        []ModelEndpoint{},
+			RequestTimeout:       60,
+			EmbeddingUrl:         "https://api.openai.com/v1/embeddings",
+			EmbeddingModel:       "text-embedding-ada-002",
+			AllowedModels:        []string{"gpt-3.5-turbo"},
+			UserSettableParams:   []string{},
 			ResponseMaxTokens:    4000,
 			GroupChatMaxTokens:   4000,
 			PrivateChatMaxTokens: 4000,
 			DefaultTemperature:   0.9,
 			InitialPrompts:       "",
-			MinInterval:          1,
+			Personas:             map[string]Persona{},
+		},
+		Storage: StorageConfig{
+			Backend: "redis",
+			File:    "nerdbot.db",
 		},
 		Redis: RedisConfig{
 			Address:  "127.0.0.1:6379",
 			Password: "",
 			Database: 0,
 		},
+		Moderation: ModerationConfig{
+			Enable:           false,
+			DictionaryFile:   "sensitive_words.txt",
+			EnableOpenAI:     false,
+			ModerationUrl:    "https://api.openai.com/v1/moderations",
+			InputAction:      "refuse",
+			OutputAction:     "refuse",
+			NotifyAdmins:     false,
+			RefuseMessage:    "[错误]您的消息包含敏感内容，无法处理",
+			BlockedReplyText: "[通知]该回复包含敏感内容，已被拦截",
+		},
+		Cache: ResponseCacheConfig{
+			Enable:              false,
+			TTL:                 86400,
+			EnableEmbedding:     false,
+			SimilarityThreshold: 0.95,
+			MaxEntries:          1000,
+		},
+		Knowledge: KnowledgeBaseConfig{
+			Enable:        false,
+			Directory:     "knowledge",
+			ChunkSize:     500,
+			ChunkOverlap:  50,
+			TopK:          3,
+			MinSimilarity: 0.75,
+		},
+		Usage: UsageConfig{
+			Currency: "USD",
+			Prices: map[string]ModelPrice{
+				"gpt-3.5-turbo": {Prompt: 0.0015, Completion: 0.002},
+				"gpt-4":         {Prompt: 0.03, Completion: 0.06},
+			},
+			RetentionDays: 400,
+		},
+		RateLimit: RateLimitConfig{
+			User:          BucketLimit{Rate: 1, Burst: 3},
+			Group:         BucketLimit{Rate: 0.5, Burst: 5},
+			Global:        BucketLimit{Rate: 0, Burst: 0},
+			RejectAction:  "warn",
+			RejectMessage: "别急，让我仔细想想[发送频率过快]",
+		},
+		EventQueue: EventQueueConfig{
+			Workers:      8,
+			QueueSize:    64,
+			Overflow:     "drop",
+			BlockTimeout: 3,
+		},
+		Audit: AuditConfig{
+			Enable:        false,
+			Directory:     "audit",
+			MaxSize:       100,
+			RetentionDays: 90,
+			Privacy:       false,
+			HashSalt:      "",
+		},
+		Access: AccessConfig{
+			PrivateAllowListOnly: false,
+			GroupAllowListOnly:   false,
+		},
+		Command: CommandConfig{
+			Prefixes:      []string{"NerdBot "},
+			Aliases:       map[string]string{},
+			TriggerOnName: false,
+			Triggers:      []string{},
+		},
+		Export: ExportConfig{
+			Mode:      "file",
+			Directory: "export",
+		},
+		Retention: RetentionConfig{
+			Private: RetentionPolicy{
+				IdleTTL:    604800,
+				DailyReset: "07:00",
+			},
+			Group: RetentionPolicy{
+				IdleTTL:    604800,
+				DailyReset: "07:00",
+			},
+		},
 		Greeting: GreetingConfig{
 			EnableGreeting: false,
 			GreetingMessage: Message{
@@ -113,7 +348,10 @@ func InitGlobalConfig() error {
 		if err != nil {
 			return err
 		}
-		GlobalConfig.AI.EnableGroupChat = make(map[int64]bool)
+		err = migrateMinInterval(yamlFile)
+		if err != nil {
+			return err
+		}
 	} else {
 		// Save default config to YAML file if it does not exist
 		yamlData, err := yaml.Marshal(GlobalConfig)
@@ -129,3 +367,31 @@ func InitGlobalConfig() error {
 	}
 	return nil
 }
+
+// migrateMinInterval maps the removed openAI.minInterval setting to the per user rate limit, unless
+// rateLimit.user is configured as well.
+func migrateMinInterval(yamlFile []byte) error {
+	var legacy struct {
+		AI struct {
+			MinInterval *float64 `yaml:"minInterval"`
+		} `yaml:"openAI"`
+		RateLimit struct {
+			User *BucketLimit `yaml:"user"`
+		} `yaml:"rateLimit"`
+	}
+	err := yaml.Unmarshal(yamlFile, &legacy)
+	if err != nil || legacy.AI.MinInterval == nil {
+		return err
+	}
+	if legacy.RateLimit.User != nil {
+		logrus.Warning("openAI.minInterval is deprecated and ignored in favour of rateLimit.user, please remove it from config.yaml")
+		return nil
+	}
+	GlobalConfig.RateLimit.User = BucketLimit{Rate: 0, Burst: 1}
+	if *legacy.AI.MinInterval > 0 {
+		GlobalConfig.RateLimit.User.Rate = 1 / *legacy.AI.MinInterval
+	}
+	logrus.Warningf("openAI.minInterval is deprecated, using it as rateLimit.user {rate: %g, burst: 1}. Please move it to rateLimit.user in config.yaml",
+		GlobalConfig.RateLimit.User.Rate)
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestMigrateMinInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want BucketLimit
+	}{
+		{"not set", "openAI:\n  model: gpt-3.5-turbo\n", BucketLimit{Rate: 1, Burst: 3}},
+		{"mapped", "openAI:\n  minInterval: 2\n", BucketLimit{Rate: 0.5, Burst: 1}},
+		{"disabled", "openAI:\n  minInterval: 0\n", BucketLimit{Rate: 0, Burst: 1}},
+		{"rate limit wins", "openAI:\n  minInterval: 2\nrateLimit:\n  user:\n    rate: 3\n    burst: 6\n", BucketLimit{Rate: 1, Burst: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, &Config{RateLimit: RateLimitConfig{User: BucketLimit{Rate: 1, Burst: 3}}})
+			if err := migrateMinInterval([]byte(tt.yaml)); err != nil {
+				t.Fatal(err)
+			}
+			if got := GlobalConfig.RateLimit.User; got != tt.want {
+				t.Errorf("rateLimit.user = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
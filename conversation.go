@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// maxConversations is the number of conversations a chat may keep at the same time.
+const maxConversations = 10
+
+type Conversation struct {
+	Id        int       `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ConversationIndex lists the conversations of a user or group and tracks the active one.
+type ConversationIndex struct {
+	Active        int            `json:"active"`
+	NextId        int            `json:"nextId"`
+	Conversations []Conversation `json:"conversations"`
+}
+
+func DefaultConversationIndex() *ConversationIndex {
+	return &ConversationIndex{
+		Active: 1,
+		NextId: 2,
+		Conversations: []Conversation{
+			{Id: 1, Title: "默认对话"},
+		},
+	}
+}
+
+func (index *ConversationIndex) find(id int) int {
+	for i, conversation := range index.Conversations {
+		if conversation.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add creates a conversation and makes it the active one. It fails if the chat already holds maxConversations.
+func (index *ConversationIndex) Add(title string) (Conversation, bool) {
+	if len(index.Conversations) >= maxConversations {
+		return Conversation{}, false
+	}
+	conversation := Conversation{Id: index.NextId, Title: title, CreatedAt: time.Now()}
+	if conversation.Title == "" {
+		conversation.Title = "对话" + strconv.Itoa(conversation.Id)
+	}
+	index.NextId++
+	index.Conversations = append(index.Conversations, conversation)
+	index.Active = conversation.Id
+	return conversation, true
+}
+
+// ActiveTitle returns the title of the active conversation.
+func (index *ConversationIndex) ActiveTitle() string {
+	if i := index.find(index.Active); i >= 0 {
+		return index.Conversations[i].Title
+	}
+	return ""
+}
+
+func (index *ConversationIndex) Text() string {
+	text := "[通知]对话列表:"
+	for _, conversation := range index.Conversations {
+		text += fmt.Sprintf("\n%d. %s", conversation.Id, conversation.Title)
+		if conversation.Id == index.Active {
+			text += " (当前)"
+		}
+	}
+	return text
+}
+
+// ExecuteConversationCommand handles "NerdBot new [title]|list|switch <n>|delete <n>". Changing the
+// conversations of a shared group session requires admin permission.
+func (req QQMessage) ExecuteConversationCommand(command string, arg string, idStr string, shared bool, isAdmin bool) string {
+	index, err := RetrieveConversationIndex(idStr)
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]获取对话列表失败"
+	}
+	if command == "list" {
+		return index.Text()
+	}
+	if shared && !isAdmin {
+		return "[错误]\n对不起，您没有权限执行该命令"
+	}
+	var text string
+	switch command {
+	case "new":
+		conversation, ok := index.Add(arg)
+		if !ok {
+			return fmt.Sprintf("[错误]最多同时保留%d个对话，请先删除不需要的对话", maxConversations)
+		}
+		text = fmt.Sprintf("[通知]已创建并切换到对话%d: %s", conversation.Id, conversation.Title)
+	case "switch":
+		id, err := strconv.Atoi(arg)
+		if err != nil || index.find(id) < 0 {
+			return "[错误]未找到对话: " + arg
+		}
+		index.Active = id
+		text = fmt.Sprintf("[通知]已切换到对话%d: %s", id, index.Conversations[index.find(id)].Title)
+	case "delete":
+		id, err := strconv.Atoi(arg)
+		i := index.find(id)
+		if err != nil || i < 0 {
+			return "[错误]未找到对话: " + arg
+		}
+		if len(index.Conversations) == 1 {
+			return "[错误]无法删除唯一的对话，如需清除上下文请使用clear"
+		}
+		err = DeleteConversationRecord(idStr, id)
+		if err != nil {
+			logrus.Error(err)
+			return "[错误]删除对话失败"
+		}
+		index.Conversations = append(index.Conversations[:i], index.Conversations[i+1:]...)
+		text = fmt.Sprintf("[通知]对话%d已删除", id)
+		if index.Active == id {
+			index.Active = index.Conversations[0].Id
+			text += fmt.Sprintf("，已切换到对话%d: %s", index.Active, index.Conversations[0].Title)
+		}
+	}
+	err = StoreConversationIndex(idStr, index)
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]保存对话列表失败"
+	}
+	return text
+}
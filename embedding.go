@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+)
+
+type EmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type EmbeddingResponse struct {
+	Data []struct {
+		Embedding []float64 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// GetEmbeddings returns the embedding vectors of inputs, in the same order.
+func GetEmbeddings(inputs []string) ([][]float64, error) {
+	body, err := json.Marshal(EmbeddingRequest{
+		Model: GlobalConfig.AI.EmbeddingModel,
+		Input: inputs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", GlobalConfig.AI.EmbeddingUrl, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := AIClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error AIError `json:"error"`
+		}
+		_ = json.Unmarshal(responseBody, &errResp)
+		errResp.Error.StatusCode = resp.StatusCode
+		return nil, &errResp.Error
+	}
+	var embeddingResp EmbeddingResponse
+	err = json.Unmarshal(responseBody, &embeddingResp)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddingResp.Data) != len(inputs) {
+		return nil, errors.New("embedding count does not match input count")
+	}
+	embeddings := make([][]float64, len(inputs))
+	for _, data := range embeddingResp.Data {
+		if data.Index < 0 || data.Index >= len(embeddings) {
+			return nil, errors.New("embedding index out of range")
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+	return embeddings, nil
+}
+
+func GetEmbedding(input string) ([]float64, error) {
+	embeddings, err := GetEmbeddings([]string{input})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+func CosineSimilarity(a []float64, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type queuedEvent struct {
+	req   QQMessage
+	admin bool
+}
+
+type sessionEvents struct {
+	events []queuedEvent
+	// admins is the number of queued events of admins
+	admins int
+}
+
+// eventWorker queues the events of each session in order. Sessions with queued events wait in one of two
+// lists, sessions with an event of an admin in the priority list, and take turns to have one event processed.
+type eventWorker struct {
+	// slots holds one element per queued event, bounding the queue of the worker
+	slots    chan struct{}
+	wake     chan struct{}
+	mu       sync.Mutex
+	sessions map[string]*sessionEvents
+	priority []string
+	normal   []string
+}
+
+func (w *eventWorker) push(req QQMessage, admin bool) {
+	w.mu.Lock()
+	key := req.sessionKey()
+	session, queued := w.sessions[key]
+	if !queued {
+		session = &sessionEvents{}
+		w.sessions[key] = session
+	}
+	session.events = append(session.events, queuedEvent{req: req, admin: admin})
+	if admin {
+		session.admins++
+	}
+	if !queued {
+		w.schedule(key, session)
+	} else if admin && session.admins == 1 {
+		// the session waits in the normal list, move it ahead
+		for i, normal := range w.normal {
+			if normal == key {
+				w.normal = append(w.normal[:i], w.normal[i+1:]...)
+				break
+			}
+		}
+		w.priority = append(w.priority, key)
+	}
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *eventWorker) schedule(key string, session *sessionEvents) {
+	if session.admins > 0 {
+		w.priority = append(w.priority, key)
+	} else {
+		w.normal = append(w.normal, key)
+	}
+}
+
+// next takes the first event of the next session, preferring the sessions with an event of an admin.
+func (w *eventWorker) next() (QQMessage, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var key string
+	if len(w.priority) > 0 {
+		key, w.priority = w.priority[0], w.priority[1:]
+	} else if len(w.normal) > 0 {
+		key, w.normal = w.normal[0], w.normal[1:]
+	} else {
+		return QQMessage{}, false
+	}
+	session := w.sessions[key]
+	event := session.events[0]
+	session.events = session.events[1:]
+	if event.admin {
+		session.admins--
+	}
+	if len(session.events) == 0 {
+		delete(w.sessions, key)
+	} else {
+		w.schedule(key, session)
+	}
+	return event.req, true
+}
+
+// EventQueue processes received events on a fixed number of workers. All events of a session are queued
+// to the same worker, so they are processed in the order they were received. Sessions with an event of an
+// admin are served before the others, but an event never overtakes the earlier events of its session.
+type EventQueue struct {
+	config    EventQueueConfig
+	workers   []*eventWorker
+	handle    func(QQMessage)
+	received  atomic.Uint64
+	processed atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+type EventQueueStats struct {
+	Received  uint64 `json:"received"`
+	Processed uint64 `json:"processed"`
+	Dropped   uint64 `json:"dropped"`
+	Queued    int    `json:"queued"`
+}
+
+var Events *EventQueue
+
+func NewEventQueue(config EventQueueConfig, handle func(QQMessage)) *EventQueue {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1
+	}
+	queue := &EventQueue{config: config, handle: handle, workers: make([]*eventWorker, config.Workers)}
+	for i := range queue.workers {
+		queue.workers[i] = &eventWorker{
+			slots:    make(chan struct{}, config.QueueSize),
+			wake:     make(chan struct{}, 1),
+			sessions: make(map[string]*sessionEvents),
+		}
+	}
+	return queue
+}
+
+func (q *EventQueue) Start() {
+	for _, worker := range q.workers {
+		go q.run(worker)
+	}
+}
+
+func (q *EventQueue) run(worker *eventWorker) {
+	for {
+		req, ok := worker.next()
+		if !ok {
+			<-worker.wake
+			continue
+		}
+		<-worker.slots
+		q.process(req)
+	}
+}
+
+func (q *EventQueue) process(req QQMessage) {
+	defer q.processed.Add(1)
+	defer func() {
+		// a failing event must not stop the worker and the sessions queued to it
+		if r := recover(); r != nil {
+			logrus.Error("[EventQueue]handle event panic: ", r)
+		}
+	}()
+	q.handle(req)
+}
+
+// sessionKey returns the session an event belongs to, which decides the worker it is queued to.
+func (req QQMessage) sessionKey() string {
+	if req.MessageType == "group" {
+		return "group:" + strconv.FormatInt(req.GroupId, 10)
+	}
+	return "private:" + strconv.FormatInt(req.UserId, 10)
+}
+
+// Submit queues an event and reports whether it was accepted. If the queue of its worker is full, the event
+// is dropped at once or, with the block overflow policy, after waiting for room for BlockTimeout seconds.
+func (q *EventQueue) Submit(req QQMessage) bool {
+	q.received.Add(1)
+	hash := fnv.New32a()
+	hash.Write([]byte(req.sessionKey()))
+	worker := q.workers[hash.Sum32()%uint32(len(q.workers))]
+	select {
+	case worker.slots <- struct{}{}:
+		worker.push(req, IsAdmin(req.UserId))
+		return true
+	default:
+	}
+	if q.config.Overflow == "block" {
+		timer := time.NewTimer(time.Duration(q.config.BlockTimeout) * time.Second)
+		defer timer.Stop()
+		select {
+		case worker.slots <- struct{}{}:
+			worker.push(req, IsAdmin(req.UserId))
+			return true
+		case <-timer.C:
+		}
+	}
+	dropped := q.dropped.Add(1)
+	logrus.Warnf("[EventQueue]queue of %s is full, event dropped (%d dropped in total)", req.sessionKey(), dropped)
+	return false
+}
+
+func (q *EventQueue) Stats() EventQueueStats {
+	stats := EventQueueStats{
+		Received:  q.received.Load(),
+		Processed: q.processed.Load(),
+		Dropped:   q.dropped.Load(),
+	}
+	for _, worker := range q.workers {
+		stats.Queued += len(worker.slots)
+	}
+	return stats
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testAdminId = 1
+
+// testEvent returns a message of user in group, or a private message if group is 0, identified by id.
+func testEvent(id int64, user int64, group int64) QQMessage {
+	if group == 0 {
+		return QQMessage{MessageId: id, UserId: user, MessageType: "private"}
+	}
+	return QQMessage{MessageId: id, UserId: user, GroupId: group, MessageType: "group"}
+}
+
+// processEvents submits events to a stopped queue, starts it and returns the ids of the events in the order
+// they were handled.
+func processEvents(t *testing.T, config EventQueueConfig, events []QQMessage, handle func(QQMessage)) ([]int64, *EventQueue) {
+	t.Helper()
+	handled := make(chan int64, len(events))
+	queue := NewEventQueue(config, func(req QQMessage) {
+		handled <- req.MessageId
+		if handle != nil {
+			handle(req)
+		}
+	})
+	accepted := 0
+	for _, event := range events {
+		if queue.Submit(event) {
+			accepted++
+		}
+	}
+	queue.Start()
+	var order []int64
+	timeout := time.After(time.Second)
+	for len(order) < accepted {
+		select {
+		case id := <-handled:
+			order = append(order, id)
+		case <-timeout:
+			t.Fatalf("handled %v, want %d events", order, accepted)
+		}
+	}
+	return order, queue
+}
+
+func TestEventQueueOrder(t *testing.T) {
+	setTestConfig(t, &Config{Server: ServerConfig{AdminIds: []int64{testAdminId}}})
+	tests := []struct {
+		name   string
+		events []QQMessage
+		want   []int64
+	}{
+		{
+			"sessions take turns",
+			[]QQMessage{testEvent(11, 2, 100), testEvent(12, 2, 100), testEvent(21, 3, 0), testEvent(22, 3, 0)},
+			[]int64{11, 21, 12, 22},
+		},
+		{
+			"admin session first",
+			[]QQMessage{testEvent(11, 2, 100), testEvent(21, 3, 200), testEvent(22, testAdminId, 200)},
+			[]int64{21, 22, 11},
+		},
+		{
+			"admin event never overtakes its session",
+			[]QQMessage{
+				testEvent(11, 2, 100), testEvent(12, 2, 100),
+				testEvent(21, 3, 200), testEvent(22, 4, 200), testEvent(23, testAdminId, 200),
+			},
+			[]int64{21, 22, 23, 11, 12},
+		},
+		{
+			"private chats of the same user in order",
+			[]QQMessage{testEvent(11, 2, 0), testEvent(12, 2, 0), testEvent(13, 2, 0)},
+			[]int64{11, 12, 13},
+		},
+	}
+	for _, tt := range tests {
+		got, _ := processEvents(t, EventQueueConfig{Workers: 1, QueueSize: 16}, tt.events, nil)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: handled %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEventQueueOverflow(t *testing.T) {
+	setTestConfig(t, &Config{})
+	events := []QQMessage{testEvent(11, 2, 100), testEvent(12, 2, 100), testEvent(13, 2, 100)}
+	got, queue := processEvents(t, EventQueueConfig{Workers: 1, QueueSize: 2, Overflow: "drop"}, events, nil)
+	if want := []int64{11, 12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("handled %v, want %v", got, want)
+	}
+	if stats := queue.Stats(); stats.Received != 3 || stats.Dropped != 1 {
+		t.Errorf("stats = %+v, want 3 received and 1 dropped", stats)
+	}
+}
+
+func TestEventQueueRecoversFromPanic(t *testing.T) {
+	setTestConfig(t, &Config{})
+	events := []QQMessage{testEvent(11, 2, 100), testEvent(12, 2, 100)}
+	got, _ := processEvents(t, EventQueueConfig{Workers: 1, QueueSize: 2}, events, func(req QQMessage) {
+		if req.MessageId == 11 {
+			panic("failing event")
+		}
+	})
+	if want := []int64{11, 12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("handled %v, want %v", got, want)
+	}
+}
+
+func TestMetricsAuthorized(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		url    string
+		header string
+		want   bool
+	}{
+		{"no token configured", "", "/metrics", "", true},
+		{"missing", "secret", "/metrics", "", false},
+		{"bearer", "secret", "/metrics", "Bearer secret", true},
+		{"wrong bearer", "secret", "/metrics?access_token=secret", "Bearer wrong", false},
+		{"query", "secret", "/metrics?access_token=secret", "", true},
+		{"wrong query", "secret", "/metrics?access_token=secre", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, &Config{OneBot11: OneBot11Config{AccessToken: tt.token}})
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if got := metricsAuthorized(req); got != tt.want {
+				t.Errorf("metricsAuthorized() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ConversationExport struct {
+	Title      string    `json:"title"`
+	ExportedAt time.Time `json:"exportedAt"`
+	Record     *Record   `json:"record"`
+}
+
+// speakerName returns the name a message is shown with in exports.
+func speakerName(message ChatMessage) string {
+	switch message.Role {
+	case "system":
+		return "系统设定"
+	case "assistant":
+		if GlobalConfig.OneBot11.SelfNickname != "" {
+			return GlobalConfig.OneBot11.SelfNickname
+		}
+		return "NerdBot"
+	case "user":
+		if message.UserId != "" {
+			return "用户" + message.UserId
+		}
+		return "用户"
+	}
+	return message.Role
+}
+
+func (export ConversationExport) Markdown() string {
+	var builder strings.Builder
+	builder.WriteString("# " + export.Title + "\n\n")
+	builder.WriteString("> 导出于 " + export.ExportedAt.Format("2006-01-02 15:04:05") +
+		"，模型 " + export.Record.EffectiveModel() + "\n")
+	for _, message := range export.Record.Messages {
+		if message.Content == "" {
+			continue
+		}
+		builder.WriteString("\n**" + speakerName(message) + "**:\n\n" + message.Content + "\n")
+	}
+	return builder.String()
+}
+
+// ExecuteExportCommand handles "NerdBot export [md|json]". The conversation is sent as a file or as a
+// merged forward message, depending on the configured mode.
+func (req QQMessage) ExecuteExportCommand(format string, idStr string) string {
+	if format == "" {
+		format = "md"
+	}
+	if format != "md" && format != "json" {
+		return "[错误]用法: NerdBot export [md|json]"
+	}
+	record, err := RetrieveOrDefaultRecord(idStr)
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]导出失败:获取记录失败"
+	}
+	if len(record.Messages) <= 1 {
+		return "[错误]当前对话没有可导出的内容"
+	}
+	index, err := RetrieveConversationIndex(idStr)
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]导出失败:获取对话列表失败"
+	}
+	export := ConversationExport{Title: index.ActiveTitle(), ExportedAt: time.Now(), Record: record}
+	userId, groupId := strconv.FormatInt(req.UserId, 10), strconv.FormatInt(req.GroupId, 10)
+	if GlobalConfig.Export.Mode == "forward" {
+		err = SendForwardMsg(req.MessageType, userId, groupId, export.ForwardNodes())
+		if err != nil {
+			logrus.Error("send forward message fail: ", err)
+			return "[错误]导出失败:发送合并转发消息失败"
+		}
+		return "[通知]对话已导出"
+	}
+	var content []byte
+	if format == "json" {
+		content, err = json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			logrus.Error(err)
+			return "[错误]导出失败"
+		}
+	} else {
+		content = []byte(export.Markdown())
+	}
+	chatId := userId
+	if req.MessageType == "group" {
+		chatId = groupId
+	}
+	name := fmt.Sprintf("NerdBot-%s-%s.%s", chatId, export.ExportedAt.Format("20060102-150405"), format)
+	path, err := filepath.Abs(filepath.Join(GlobalConfig.Export.Directory, name))
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(path, content, 0644)
+	}
+	if err != nil {
+		logrus.Error("write export file fail: ", err)
+		return "[错误]导出失败:写入文件失败"
+	}
+	// the upload action returns once the OneBot implementation has read the file
+	defer func() {
+		if err := os.Remove(path); err != nil {
+			logrus.Error("remove export file fail: ", err)
+		}
+	}()
+	err = UploadFile(req.MessageType, userId, groupId, path, name)
+	if err != nil {
+		logrus.Error("upload export file fail: ", err)
+		return "[错误]导出失败:上传文件失败"
+	}
+	return "[通知]对话已导出为文件" + name
+}
+
+func (export ConversationExport) ForwardNodes() []Message {
+	selfId := strconv.FormatInt(GlobalConfig.OneBot11.SelfId, 10)
+	nodes := []Message{ForwardNode("NerdBot", selfId, export.Title+"\n导出于 "+export.ExportedAt.Format("2006-01-02 15:04:05"))}
+	for _, message := range export.Record.Messages {
+		if message.Content == "" || message.Role == "system" {
+			continue
+		}
+		uin := selfId
+		if message.UserId != "" {
+			uin = message.UserId
+		}
+		nodes = append(nodes, ForwardNode(speakerName(message), uin, message.Content))
+	}
+	return nodes
+}
+
+// ExecuteImportCommand handles the admin command "NerdBot import <json>", which restores an exported
+// conversation as a new conversation of the chat.
+func (req QQMessage) ExecuteImportCommand(exportJSON string, idStr string) string {
+	var export ConversationExport
+	err := json.Unmarshal([]byte(UnescapeCQ(exportJSON)), &export)
+	if err != nil || export.Record == nil || len(export.Record.Messages) == 0 {
+		return "[错误]无效的对话JSON，请使用NerdBot export json导出的内容"
+	}
+	index, err := RetrieveConversationIndex(idStr)
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]导入失败:获取对话列表失败"
+	}
+	title := export.Title
+	if title == "" {
+		title = "导入的对话"
+	}
+	conversation, ok := index.Add(title)
+	if !ok {
+		return fmt.Sprintf("[错误]最多同时保留%d个对话，请先删除不需要的对话", maxConversations)
+	}
+	// the record is written first, so that the index never points to a conversation without its record
+	err = StoreConversationRecord(idStr, conversation.Id, export.Record)
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]导入失败:存储记录失败"
+	}
+	err = StoreConversationIndex(idStr, index)
+	if err != nil {
+		logrus.Error(err)
+		if err := DeleteConversationRecord(idStr, conversation.Id); err != nil {
+			logrus.Error(err)
+		}
+		return "[错误]导入失败:保存对话列表失败"
+	}
+	return fmt.Sprintf("[通知]已导入并切换到对话%d: %s", conversation.Id, conversation.Title)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+var fileStorageBucket = []byte("nerdbot")
+
+// NewFileStorage opens a MemoryStorage backed by a single bbolt database file, so that NerdBot can run
+// without Redis. All data is loaded on start and every change is written through to the file. A change that
+// cannot be written is undone in memory as well, so that memory and file never diverge.
+func NewFileStorage(file string) (*MemoryStorage, error) {
+	db, err := bbolt.Open(file, 0600, &bbolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	storage := NewMemoryStorage()
+	m := storage.store
+	now := time.Now()
+	m.mu.Lock()
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(fileStorageBucket)
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		err = bucket.ForEach(func(key, value []byte) error {
+			var e memoryEntry
+			err := json.Unmarshal(value, &e)
+			if err != nil {
+				return err
+			}
+			if e.expired(now) {
+				expired = append(expired, append([]byte(nil), key...))
+			} else {
+				m.entries[string(key)] = &e
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err = bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	m.mu.Unlock()
+	if err != nil {
+		storage.Close()
+		db.Close()
+		return nil, err
+	}
+	m.persist = func(entries map[string]*memoryEntry, keys []string) error {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket(fileStorageBucket)
+			for _, key := range keys {
+				e := entries[key]
+				if e == nil {
+					if err := bucket.Delete([]byte(key)); err != nil {
+						return err
+					}
+					continue
+				}
+				value, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				if err = bucket.Put([]byte(key), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// the file was left as it was, so the changes are undone in memory as well
+			if restoreErr := restoreEntries(db, entries, keys); restoreErr != nil {
+				logrus.Error("restore storage entries fail: ", restoreErr)
+			}
+		}
+		return err
+	}
+	m.close = db.Close
+	return storage, nil
+}
+
+// restoreEntries reloads the entries of keys from the file.
+func restoreEntries(db *bbolt.DB, entries map[string]*memoryEntry, keys []string) error {
+	return db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(fileStorageBucket)
+		for _, key := range keys {
+			value := bucket.Get([]byte(key))
+			if value == nil {
+				delete(entries, key)
+				continue
+			}
+			var e memoryEntry
+			if err := json.Unmarshal(value, &e); err != nil {
+				return err
+			}
+			entries[key] = &e
+		}
+		return nil
+	})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GroupSettings are the settings of a group that admins change at runtime.
+type GroupSettings struct {
+	// GroupMode makes all members of the group share one session
+	GroupMode bool `json:"groupMode,omitempty"`
+	// Persona is the default persona of the session of the group in group mode
+	Persona string `json:"persona,omitempty"`
+	// Disabled makes the bot ignore the group except for admin commands
+	Disabled bool `json:"disabled,omitempty"`
+	// Allowed puts the group on the allow list, which is used if access.groupAllowListOnly is set
+	Allowed bool `json:"allowed,omitempty"`
+	// Triggers are the words or regular expressions that address the bot besides @ and replies
+	Triggers []string `json:"triggers,omitempty"`
+	// Quota replaces quota.group of config.yaml for the group
+	Quota *QuotaLimit `json:"quota,omitempty"`
+}
+
+// groupSettingsCacheTTL bounds how long a cached entry is used if an invalidation message was missed,
+// e.g. while the connection to Redis was interrupted.
+const groupSettingsCacheTTL = time.Minute
+
+type cachedGroupSettings struct {
+	settings GroupSettings
+	loadedAt time.Time
+}
+
+var groupSettingsCache = struct {
+	sync.RWMutex
+	entries map[string]cachedGroupSettings
+}{entries: make(map[string]cachedGroupSettings)}
+
+func groupSettingsKey(groupId string) string {
+	return ChatKey("group", groupId) + ":settings"
+}
+
+func groupSettingsChannel() string {
+	return Key("settings", "invalidate")
+}
+
+// SubscribeGroupSettings drops cached settings whenever any instance changes them.
+func SubscribeGroupSettings() error {
+	return Store.Subscribe(groupSettingsChannel(), invalidateGroupSettings)
+}
+
+func invalidateGroupSettings(groupId string) {
+	groupSettingsCache.Lock()
+	delete(groupSettingsCache.entries, groupId)
+	groupSettingsCache.Unlock()
+}
+
+func loadGroupSettings(store Storage, groupId string) (GroupSettings, error) {
+	var settings GroupSettings
+	settingsJSON, err := store.Get(groupSettingsKey(groupId))
+	if err == ErrKeyNotFound {
+		return settings, nil
+	} else if err != nil {
+		return settings, err
+	}
+	err = json.Unmarshal([]byte(settingsJSON), &settings)
+	return settings, err
+}
+
+// GetGroupSettings returns the settings of a group, from the cache if possible.
+func GetGroupSettings(groupId string) (GroupSettings, error) {
+	groupSettingsCache.RLock()
+	cached, ok := groupSettingsCache.entries[groupId]
+	groupSettingsCache.RUnlock()
+	if ok && time.Since(cached.loadedAt) < groupSettingsCacheTTL {
+		return cached.settings, nil
+	}
+	settings, err := loadGroupSettings(Store, groupId)
+	if err != nil {
+		return settings, err
+	}
+	groupSettingsCache.Lock()
+	groupSettingsCache.entries[groupId] = cachedGroupSettings{settings: settings, loadedAt: time.Now()}
+	groupSettingsCache.Unlock()
+	return settings, nil
+}
+
+// GroupSettingsOrDefault returns the settings of a group, or the defaults if they cannot be read.
+func GroupSettingsOrDefault(groupId int64) GroupSettings {
+	settings, err := GetGroupSettings(strconv.FormatInt(groupId, 10))
+	if err != nil {
+		logrus.Error("get group settings fail: ", err)
+	}
+	return settings
+}
+
+// UpdateGroupSettings applies update to the settings of a group and tells every instance to reload them.
+// An error returned by update aborts the update and is returned as is.
+func UpdateGroupSettings(groupId string, update func(settings *GroupSettings) error) error {
+	key := groupSettingsKey(groupId)
+	var err error
+	for i := 0; i < maxRecordUpdateRetries; i++ {
+		err = Store.Watch(func(tx Storage) error {
+			settings, err := loadGroupSettings(tx, groupId)
+			if err != nil {
+				return err
+			}
+			err = update(&settings)
+			if err != nil {
+				return err
+			}
+			settingsJSON, err := json.Marshal(settings)
+			if err != nil {
+				return err
+			}
+			return tx.Pipelined(func(pipe Storage) error {
+				return pipe.Set(key, string(settingsJSON), 0)
+			})
+		}, key)
+		if err != ErrTxConflict {
+			break
+		}
+	}
+	if err == ErrTxConflict {
+		return fmt.Errorf("update group settings: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	invalidateGroupSettings(groupId)
+	if err = Store.Publish(groupSettingsChannel(), groupId); err != nil {
+		logrus.Error("publish group settings change fail: ", err)
+	}
+	return nil
+}
+
+// Enabled reports whether the bot talks in the group: it is not disabled and, if access.groupAllowListOnly
+// is set, on the allow list.
+func (settings GroupSettings) Enabled() bool {
+	return !settings.Disabled && (!GlobalConfig.Access.GroupAllowListOnly || settings.Allowed)
+}
+
+// groupIdOfChatKey returns the group of a group session key made by ChatKey.
+func groupIdOfChatKey(key string) (string, bool) {
+	prefix := ChatKey("group", "")
+	if !strings.HasPrefix(key, prefix) || strings.Contains(key[len(prefix):], ":") {
+		return "", false
+	}
+	return key[len(prefix):], true
+}
+
+func (settings GroupSettings) Text(groupId string) string {
+	mode := "1 vs 1"
+	if settings.GroupMode {
+		mode = "群聊模式"
+	}
+	persona := settings.Persona
+	if persona == "" {
+		persona = "默认"
+	}
+	text := fmt.Sprintf("[通知]群%s的设置:\n对话模式: %s\n人格: %s\n已禁用: %t", groupId, mode, persona, settings.Disabled)
+	if GlobalConfig.Access.GroupAllowListOnly {
+		text += fmt.Sprintf("\n在白名单中: %t", settings.Allowed)
+	}
+	if len(settings.Triggers) > 0 {
+		text += "\n触发词: " + strings.Join(settings.Triggers, ", ")
+	}
+	if settings.Quota != nil {
+		text += fmt.Sprintf("\n额度: 每日%d tokens，每月%d tokens", settings.Quota.DailyTokens, settings.Quota.MonthlyTokens)
+	}
+	return text
+}
+
+// ExecuteGroupCommand handles the admin commands "NerdBot group settings",
+// "NerdBot group quota <dailyTokens> <monthlyTokens>|reset" and "NerdBot group trigger add|remove <regexp>" in a group.
+func (req QQMessage) ExecuteGroupCommand(fields []string) string {
+	groupId := strconv.FormatInt(req.GroupId, 10)
+	if len(fields) == 0 || fields[0] == "settings" {
+		settings, err := GetGroupSettings(groupId)
+		if err != nil {
+			logrus.Error(err)
+			return "[错误]获取群设置失败"
+		}
+		return settings.Text(groupId)
+	}
+	if fields[0] == "trigger" {
+		var action, pattern string
+		if len(fields) == 3 {
+			action, pattern = fields[1], fields[2]
+		}
+		return req.executeTriggerCommand(groupId, action, pattern)
+	}
+	if fields[0] != "quota" || len(fields) < 2 {
+		return "[错误]用法: NerdBot group settings|quota [每日tokens] [每月tokens]|quota reset|trigger add|remove [正则表达式]"
+	}
+	var quota *QuotaLimit
+	if fields[1] != "reset" {
+		quota = &QuotaLimit{}
+		var err error
+		quota.DailyTokens, err = strconv.ParseInt(fields[1], 10, 64)
+		if err == nil && len(fields) > 2 {
+			quota.MonthlyTokens, err = strconv.ParseInt(fields[2], 10, 64)
+		}
+		if err != nil || quota.DailyTokens < 0 || quota.MonthlyTokens < 0 {
+			return "[错误]无效的额度设置，值应该为非负整数，0表示不限制"
+		}
+	}
+	err := UpdateGroupSettings(groupId, func(settings *GroupSettings) error {
+		settings.Quota = quota
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]额度设置失败:存储设置失败"
+	}
+	if quota == nil {
+		return "[通知]已恢复默认的群额度"
+	}
+	return fmt.Sprintf("[通知]本群额度已设置为每日%d tokens，每月%d tokens", quota.DailyTokens, quota.MonthlyTokens)
+}
+
+// ExecuteGroupModeCommand handles the admin commands "NerdBot group mode" and "NerdBot private mode" in a group.
+// Switching the mode clears the session of the group.
+func (req QQMessage) ExecuteGroupModeCommand(enable bool) string {
+	groupId := strconv.FormatInt(req.GroupId, 10)
+	var groupMode bool
+	err := UpdateGroupSettings(groupId, func(settings *GroupSettings) error {
+		groupMode = settings.GroupMode
+		settings.GroupMode = enable
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]模式切换失败:存储设置失败"
+	}
+	if enable {
+		if groupMode {
+			return "[错误]\n群" + groupId + "的群聊模式已开启，无须重复操作。"
+		}
+		DeleteRecord(ChatKey("group", groupId))
+		return "[通知]\n群" + groupId + "的群聊模式已开启，之后所有群聊文字信息" +
+			"将以同一session供机器人进行分析。如需机器人进行回复，请在输入信息中@戴便机器人。\n注意: 此功能为实验性功能。另，群聊模式可能使用大量token，" +
+			"请注意您的token使用量。"
+	}
+	if !groupMode {
+		return "[错误]群聊模式已经为关闭状态，无须操作"
+	}
+	DeleteRecord(ChatKey("group", groupId))
+	return "[通知]\n群聊模式已关闭，机器人将恢复 1 vs 1 对话"
+}
+
+// executeTriggerCommand adds a trigger to or removes one from the triggers of a group.
+func (req QQMessage) executeTriggerCommand(groupId string, action string, pattern string) string {
+	if pattern == "" || (action != "add" && action != "remove") {
+		return "[错误]用法: NerdBot group trigger add|remove [正则表达式]"
+	}
+	pattern = UnescapeCQ(pattern)
+	if _, err := compileTrigger(pattern); err != nil {
+		return "[错误]无效的正则表达式: " + err.Error()
+	}
+	found := false
+	err := UpdateGroupSettings(groupId, func(settings *GroupSettings) error {
+		triggers := make([]string, 0, len(settings.Triggers)+1)
+		for _, trigger := range settings.Triggers {
+			if trigger == pattern {
+				found = true
+			} else {
+				triggers = append(triggers, trigger)
+			}
+		}
+		if action == "add" {
+			triggers = append(triggers, pattern)
+		}
+		settings.Triggers = triggers
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]触发词设置失败:存储设置失败"
+	}
+	if action == "remove" {
+		if !found {
+			return "[错误]本群没有该触发词: " + pattern
+		}
+		return "[通知]已删除触发词: " + pattern
+	}
+	return "[通知]已添加触发词: " + pattern + "，匹配的群消息将视为@机器人"
+}
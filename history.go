@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"strconv"
+)
+
+// errNothingToUndo aborts a record update when the conversation has no turn to undo or retry.
+var errNothingToUndo = errors.New("nothing to undo")
+
+// DropLastAnswer removes the last message if it is an answer of the bot. An answer followed by other
+// messages, e.g. the silent messages of group mode, is kept, as it is no longer the last turn.
+func (record *Record) DropLastAnswer() bool {
+	last := len(record.Messages) - 1
+	if last < 1 || record.Messages[last].Role != "assistant" {
+		return false
+	}
+	record.Messages = record.Messages[:last]
+	return true
+}
+
+// Undo removes the last answer of the bot together with the user message it answered, if the answer is the
+// last message.
+func (record *Record) Undo() bool {
+	if !record.DropLastAnswer() {
+		return false
+	}
+	if last := len(record.Messages) - 1; last > 0 && record.Messages[last].Role == "user" {
+		record.Messages = record.Messages[:last]
+	}
+	return true
+}
+
+// ExecuteRetryCommand handles "NerdBot retry [temperature]": the last answer is dropped and the model is
+// asked again, optionally at the given temperature. The new answer is sent by AIChat itself, so an empty
+// text is returned on success. Like switching conversations, retrying in a shared group session requires
+// admin permission.
+func (req QQMessage) ExecuteRetryCommand(temperature string, idStr string, mode string, isAdmin bool) string {
+	if mode == "group" && !isAdmin {
+		return "[错误]\n对不起，您没有权限执行该命令"
+	}
+	var options = chatOptions{skipCache: true}
+	if temperature != "" {
+		temp, err := strconv.ParseFloat(temperature, 64)
+		if err != nil || temp < 0 || temp > 1 {
+			return "[错误]无效的temperature设置，值应该为0~1之间的小数"
+		}
+		options.temperature = &temp
+	}
+	sender := SendMsgData{
+		MessageType: req.MessageType,
+		UserId:      strconv.FormatInt(req.UserId, 10),
+		GroupId:     strconv.FormatInt(req.GroupId, 10),
+		Message:     make([]Message, 0, 5),
+		AutoEscape:  false,
+		ReceivedMsg: req.RawMessage,
+	}
+	rateLimitMessage, ok, err := sender.CheckRateLimit()
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]重试失败:检查调用频率失败"
+	}
+	if !ok {
+		return rateLimitMessage
+	}
+	quotaMessage, ok, err := sender.CheckQuota()
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]重试失败:检查额度失败"
+	}
+	if !ok {
+		return quotaMessage
+	}
+	err = UpdateRecord(idStr, func(record *Record) error {
+		if !record.DropLastAnswer() {
+			return errNothingToUndo
+		}
+		return nil
+	})
+	if err == errNothingToUndo {
+		return "[错误]当前对话没有可重试的内容"
+	} else if err != nil {
+		logrus.Error(err)
+		return "[错误]重试失败:更新记录失败"
+	}
+	if mode == "private" {
+		sender.Message = append(sender.Message, Message{
+			Type: "reply",
+			Data: map[string]interface{}{
+				"id": req.MessageId,
+			},
+		})
+	}
+	err = sender.aiChat(mode, options)
+	if err != nil {
+		logrus.Error("AI chat in "+mode+" error: ", err)
+		return "[错误]重试失败:AI请求失败"
+	}
+	return ""
+}
+
+// ExecuteUndoCommand handles "NerdBot undo", which requires admin permission in a shared group session.
+func (req QQMessage) ExecuteUndoCommand(idStr string, mode string, isAdmin bool) string {
+	if mode == "group" && !isAdmin {
+		return "[错误]\n对不起，您没有权限执行该命令"
+	}
+	err := UpdateRecord(idStr, func(record *Record) error {
+		if !record.Undo() {
+			return errNothingToUndo
+		}
+		return nil
+	})
+	if err == errNothingToUndo {
+		return "[错误]当前对话没有可撤销的内容"
+	} else if err != nil {
+		logrus.Error(err)
+		return "[错误]撤销失败:更新记录失败"
+	}
+	return "[通知]已撤销上一轮对话"
+}
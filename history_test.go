@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMessages builds messages from "role:content" pairs.
+func testMessages(pairs ...string) []ChatMessage {
+	messages := make([]ChatMessage, 0, len(pairs))
+	for _, pair := range pairs {
+		role, content, _ := strings.Cut(pair, ":")
+		messages = append(messages, ChatMessage{Role: role, Content: content})
+	}
+	return messages
+}
+
+func TestRecordUndo(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []ChatMessage
+		ok       bool
+		want     []ChatMessage
+	}{
+		{
+			"last turn",
+			testMessages("system:s", "user:u1", "assistant:a1", "user:u2", "assistant:a2"),
+			true, testMessages("system:s", "user:u1", "assistant:a1"),
+		},
+		{
+			"answer without question",
+			testMessages("system:s", "assistant:a1"),
+			true, testMessages("system:s"),
+		},
+		{
+			"unanswered messages after the answer",
+			testMessages("system:s", "user:u1", "assistant:a1", "user:u2", "user:u3"),
+			false, testMessages("system:s", "user:u1", "assistant:a1", "user:u2", "user:u3"),
+		},
+		{"empty conversation", testMessages("system:s"), false, testMessages("system:s")},
+	}
+	for _, tt := range tests {
+		record := Record{Messages: tt.messages}
+		if ok := record.Undo(); ok != tt.ok || !reflect.DeepEqual(record.Messages, tt.want) {
+			t.Errorf("%s: Undo() = %v, %v, want %v, %v", tt.name, ok, record.Messages, tt.ok, tt.want)
+		}
+	}
+}
+
+func TestRecordDropLastAnswer(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []ChatMessage
+		ok       bool
+		want     []ChatMessage
+	}{
+		{
+			"last answer",
+			testMessages("system:s", "user:u1", "assistant:a1"),
+			true, testMessages("system:s", "user:u1"),
+		},
+		{
+			"answer in the middle",
+			testMessages("system:s", "user:u1", "assistant:a1", "user:u2", "user:u3"),
+			false, testMessages("system:s", "user:u1", "assistant:a1", "user:u2", "user:u3"),
+		},
+		{"unanswered question", testMessages("system:s", "user:u1"), false, testMessages("system:s", "user:u1")},
+		{"empty conversation", testMessages("system:s"), false, testMessages("system:s")},
+	}
+	for _, tt := range tests {
+		record := Record{Messages: tt.messages}
+		if ok := record.DropLastAnswer(); ok != tt.ok || !reflect.DeepEqual(record.Messages, tt.want) {
+			t.Errorf("%s: DropLastAnswer() = %v, %v, want %v, %v", tt.name, ok, record.Messages, tt.ok, tt.want)
+		}
+	}
+}
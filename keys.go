@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// keySchemaVersion is stored under Key("schema") once the keys of this bot instance follow the current schema.
+// Version 1 moved the keys under the namespace of the instance.
+const keySchemaVersion = 1
+
+// Key joins parts under the namespace of this bot instance: nerdbot:{platform}:{selfId}:parts...
+func Key(parts ...string) string {
+	platform, selfId := "qq", strconv.FormatInt(GlobalConfig.OneBot11.SelfId, 10)
+	if GlobalConfig.ServeMode != "onebot" {
+		platform, selfId = "wechat", GlobalConfig.OpenWechat.AppID
+	}
+	return strings.Join(append([]string{"nerdbot", platform, selfId}, parts...), ":")
+}
+
+// ChatKey returns the key prefix of a private chat or a group session, e.g. nerdbot:qq:10001:group:20002.
+func ChatKey(mode string, id string) string {
+	if mode == "group" {
+		return Key("group", id)
+	}
+	return Key("private", id)
+}
+
+var (
+	// the records were stored under the QQ id of the user or group, or under the open id of the WeChat user
+	legacyQQRecordKey     = regexp.MustCompile(`^[1-9]\d{4,}$`)
+	legacyWechatRecordKey = regexp.MustCompile(`^o[A-Za-z0-9_-]{27}$`)
+)
+
+// legacyGroupPrompt ended the system prompt of the group sessions before the key schema.
+const legacyGroupPrompt = "AI在一个群聊内，作为一个群成员参与聊天。"
+
+// legacyRecordPattern returns the scan pattern and the exact pattern of the keys of the records before the
+// key schema. Only these keys are scanned, the rest of a shared database is never looked at.
+func legacyRecordPattern() (string, *regexp.Regexp) {
+	if GlobalConfig.ServeMode != "onebot" {
+		return "o*", legacyWechatRecordKey
+	}
+	return "[1-9]*", legacyQQRecordKey
+}
+
+// decodeStrict decodes JSON written by this bot, rejecting unknown fields so that values of other
+// applications sharing the database are not taken for ours.
+func decodeStrict(data string, v interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// legacyRecord returns the record stored under key, if the key holds one, and the mode of its chat. Before the
+// key schema a private chat and a group session were told apart by their content only: the members of a group
+// session were recorded with their nicknames as role, and its system prompt ended with legacyGroupPrompt.
+func legacyRecord(key string) (*Record, string, bool) {
+	recordJSON, err := Store.Get(key)
+	if err != nil {
+		return nil, "", false
+	}
+	var record Record
+	if decodeStrict(recordJSON, &record) != nil || len(record.Messages) == 0 || record.Messages[0].Role != "system" {
+		return nil, "", false
+	}
+	mode := "private"
+	if strings.HasSuffix(record.Messages[0].Content, legacyGroupPrompt) {
+		mode = "group"
+	}
+	for _, message := range record.Messages[1:] {
+		if message.Role != "user" && message.Role != "assistant" {
+			mode = "group"
+		}
+	}
+	if mode == "group" && GlobalConfig.ServeMode != "onebot" {
+		// WeChat has no groups
+		return nil, "", false
+	}
+	return &record, mode, true
+}
+
+// convertLegacyGroupRecord converts the messages of a legacy group session to the user role with the name of
+// the member, as the messages of group sessions are recorded now.
+func convertLegacyGroupRecord(record *Record) {
+	system := &record.Messages[0]
+	system.Content = strings.TrimSuffix(system.Content, legacyGroupPrompt) + groupModePrompt
+	for i := range record.Messages[1:] {
+		message := &record.Messages[i+1]
+		if message.Role == "user" || message.Role == "assistant" {
+			continue
+		}
+		nickname := message.Role
+		message.Role = "user"
+		if nickname != "" {
+			message.Name = SanitizeMessageName(nickname)
+			message.Content = nickname + ": " + message.Content
+		}
+	}
+}
+
+// MigrateKeys migrates the stored keys from the schema version they were written in to the current one.
+func MigrateKeys() error {
+	value, err := Store.Get(Key("schema"))
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	version, _ := strconv.Atoi(value)
+	if version >= keySchemaVersion {
+		return nil
+	}
+	if err = migrateLegacyKeys(); err != nil {
+		return err
+	}
+	logrus.Infof("[KeySchema]migrated keys to version %d", keySchemaVersion)
+	return Store.Set(Key("schema"), strconv.Itoa(keySchemaVersion), 0)
+}
+
+// migrateLegacyKeys moves the records written before the key schema was introduced, which were stored under
+// bare user and group ids, under the namespace of this bot instance as the first conversation of their chat.
+// Only keys of the shape of the ids are scanned, and moved only if they decode as records.
+func migrateLegacyKeys() error {
+	pattern, recordKey := legacyRecordPattern()
+	keys, err := Store.Scan(pattern)
+	if err != nil {
+		return err
+	}
+	migrated := 0
+	for _, key := range keys {
+		if !recordKey.MatchString(key) {
+			continue
+		}
+		record, mode, ok := legacyRecord(key)
+		if !ok {
+			continue
+		}
+		if mode == "group" {
+			convertLegacyGroupRecord(record)
+		}
+		record.Mode = mode
+		newKey := conversationRecordKey(ChatKey(mode, key), 1)
+		exists, err := Store.Exists(newKey)
+		if err != nil {
+			return err
+		}
+		if exists {
+			logrus.Warnf("[KeySchema]left legacy record %s as it is: %s exists already", key, newKey)
+			continue
+		}
+		err = Store.Pipelined(func(pipe Storage) error {
+			if err := storeRecordTo(pipe, newKey, record); err != nil {
+				return err
+			}
+			return pipe.Del(key)
+		})
+		if err != nil {
+			return err
+		}
+		migrated++
+	}
+	logrus.Infof("[KeySchema]moved %d legacy records under the namespace of the instance", migrated)
+	return nil
+}
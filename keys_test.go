@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	setTestConfig(t, &Config{ServeMode: "onebot", OneBot11: OneBot11Config{SelfId: 10000}})
+	store := setTestStore(t)
+	legacy := map[string]string{
+		// a private chat
+		"10001": `{"messages":[{"role":"system","content":"你是一个助手"},{"role":"user","content":"你好"},` +
+			`{"role":"assistant","content":"你好！"}],"totalTokens":20,"lastRequest":"2023-03-01T00:00:00Z","temperature":0.9}`,
+		// a group session, recorded with the nicknames of the members as roles
+		"20002": `{"messages":[{"role":"system","content":"你是一个助手AI在一个群聊内，作为一个群成员参与聊天。"},` +
+			`{"role":"小明","content":"大家好"},{"role":"assistant","content":"你好小明"}],"totalTokens":30,` +
+			`"lastRequest":"2023-03-01T00:00:00Z","temperature":0.9}`,
+		// a group session in which nobody has talked yet
+		"20003": `{"messages":[{"role":"system","content":"AI在一个群聊内，作为一个群成员参与聊天。"}],"totalTokens":0,` +
+			`"lastRequest":"1970-01-01T00:00:00Z","temperature":0.9}`,
+		// keys of other applications sharing the database
+		"30004":      `{"messages":[{"role":"system","content":"x"}],"owner":"other"}`,
+		"40005":      `plain value`,
+		"123":        `{"messages":[{"role":"system","content":"x"}]}`,
+		"session:10": `{"messages":[{"role":"system","content":"x"}]}`,
+	}
+	for key, value := range legacy {
+		if err := store.Set(key, value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := MigrateKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		oldKey string
+		newKey string
+		mode   string
+		want   []ChatMessage
+	}{
+		{
+			"10001", "nerdbot:qq:10000:private:10001:record", "private",
+			[]ChatMessage{
+				{Role: "system", Content: "你是一个助手"},
+				{Role: "user", Content: "你好"},
+				{Role: "assistant", Content: "你好！"},
+			},
+		},
+		{
+			"20002", "nerdbot:qq:10000:group:20002:record", "group",
+			[]ChatMessage{
+				{Role: "system", Content: "你是一个助手" + groupModePrompt},
+				{Role: "user", Content: "小明: 大家好", Name: SanitizeMessageName("小明")},
+				{Role: "assistant", Content: "你好小明"},
+			},
+		},
+		{
+			"20003", "nerdbot:qq:10000:group:20003:record", "group",
+			[]ChatMessage{{Role: "system", Content: groupModePrompt}},
+		},
+	}
+	for _, tt := range tests {
+		if exists, _ := store.Exists(tt.oldKey); exists {
+			t.Errorf("%s was not moved", tt.oldKey)
+		}
+		recordJSON, err := store.Get(tt.newKey)
+		if err != nil {
+			t.Errorf("%s: get %s: %v", tt.oldKey, tt.newKey, err)
+			continue
+		}
+		var record Record
+		if err = json.Unmarshal([]byte(recordJSON), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Mode != tt.mode {
+			t.Errorf("%s: mode = %q, want %q", tt.oldKey, record.Mode, tt.mode)
+		}
+		if len(record.Messages) != len(tt.want) {
+			t.Errorf("%s: messages = %v, want %v", tt.oldKey, record.Messages, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if record.Messages[i] != tt.want[i] {
+				t.Errorf("%s: message %d = %+v, want %+v", tt.oldKey, i, record.Messages[i], tt.want[i])
+			}
+		}
+		if tracked, _ := store.SMembers(modeRecordsKey(tt.mode)); !ContainsString(tracked, tt.newKey) {
+			t.Errorf("%s: %s is not tracked for the daily reset of %s", tt.oldKey, tt.newKey, tt.mode)
+		}
+	}
+	for _, key := range []string{"30004", "40005", "123", "session:10"} {
+		if value, err := store.Get(key); err != nil || value != legacy[key] {
+			t.Errorf("foreign key %s = %q, %v, want it untouched", key, value, err)
+		}
+	}
+	if version, _ := store.Get(Key("schema")); version != "1" {
+		t.Errorf("schema = %q, want %q", version, "1")
+	}
+}
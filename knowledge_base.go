@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// embeddingBatchSize is the number of chunks embedded with a single API call.
+const embeddingBatchSize = 16
+
+type KnowledgeChunk struct {
+	Id        string    `json:"id"`
+	Source    string    `json:"source"`
+	Text      string    `json:"text"`
+	Embedding []float64 `json:"embedding"`
+}
+
+// knowledgeIndexTTL bounds how long a parsed knowledge base is used if an invalidation message was missed.
+const knowledgeIndexTTL = 10 * time.Minute
+
+type knowledgeIndex struct {
+	chunks   []KnowledgeChunk
+	loadedAt time.Time
+}
+
+// knowledgeIndexes keeps the parsed chunks of each group, so that a reply does not decode every embedding again.
+var knowledgeIndexes = struct {
+	sync.RWMutex
+	entries map[string]knowledgeIndex
+}{entries: make(map[string]knowledgeIndex)}
+
+func knowledgeChannel() string {
+	return Key("kb", "invalidate")
+}
+
+// SubscribeKnowledge drops parsed knowledge bases whenever any instance changes them.
+func SubscribeKnowledge() error {
+	return Store.Subscribe(knowledgeChannel(), invalidateKnowledge)
+}
+
+func invalidateKnowledge(groupId string) {
+	knowledgeIndexes.Lock()
+	delete(knowledgeIndexes.entries, groupId)
+	knowledgeIndexes.Unlock()
+}
+
+// knowledgeChanged tells every instance to reload the knowledge base of a group.
+func knowledgeChanged(groupId string) {
+	invalidateKnowledge(groupId)
+	if err := Store.Publish(knowledgeChannel(), groupId); err != nil {
+		logrus.Error("[KnowledgeBase]publish knowledge change fail: ", err)
+	}
+}
+
+// knowledgeChunks returns the chunks of a group, parsed once and then kept until the knowledge base changes.
+// The returned slice is shared and must not be modified.
+func knowledgeChunks(groupId string) ([]KnowledgeChunk, error) {
+	knowledgeIndexes.RLock()
+	index, ok := knowledgeIndexes.entries[groupId]
+	knowledgeIndexes.RUnlock()
+	if ok && time.Since(index.loadedAt) < knowledgeIndexTTL {
+		return index.chunks, nil
+	}
+	chunks, err := RetrieveKnowledgeChunks(groupId)
+	if err != nil {
+		return nil, err
+	}
+	knowledgeIndexes.Lock()
+	knowledgeIndexes.entries[groupId] = knowledgeIndex{chunks: chunks, loadedAt: time.Now()}
+	knowledgeIndexes.Unlock()
+	return chunks, nil
+}
+
+// ChunkText splits text into chunks of at most size runes. Paragraphs are kept together where possible,
+// and paragraphs longer than size are cut with the given overlap.
+func ChunkText(text string, size int, overlap int) []string {
+	if size <= 0 {
+		size = 500
+	}
+	if overlap < 0 || overlap >= size {
+		overlap = 0
+	}
+	var chunks []string
+	var current []rune
+	flush := func() {
+		chunk := strings.TrimSpace(string(current))
+		if chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		current = nil
+	}
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		runes := []rune(strings.TrimSpace(paragraph))
+		if len(runes) == 0 {
+			continue
+		}
+		if len(current)+len(runes)+2 > size {
+			flush()
+		}
+		for len(runes) > size {
+			chunks = append(chunks, string(runes[:size]))
+			runes = runes[size-overlap:]
+		}
+		if len(current) > 0 {
+			current = append(current, '\n', '\n')
+		}
+		current = append(current, runes...)
+	}
+	flush()
+	return chunks
+}
+
+// AddKnowledge chunks and embeds text from source into the knowledge base of a group.
+// Chunks already present are not embedded again. It returns the number of new chunks.
+func AddKnowledge(groupId string, source string, text string) (int, error) {
+	var chunks []KnowledgeChunk
+	defer knowledgeChanged(groupId)
+	for _, chunkText := range ChunkText(text, GlobalConfig.Knowledge.ChunkSize, GlobalConfig.Knowledge.ChunkOverlap) {
+		hash := sha256.Sum256([]byte(source + "\x00" + chunkText))
+		id := hex.EncodeToString(hash[:8])
+		exists, err := KnowledgeChunkExists(groupId, id)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			chunks = append(chunks, KnowledgeChunk{Id: id, Source: source, Text: chunkText})
+		}
+	}
+	for start := 0; start < len(chunks); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(chunks) {
+			end = len(chunks)
+		}
+		inputs := make([]string, 0, end-start)
+		for _, chunk := range chunks[start:end] {
+			inputs = append(inputs, chunk.Text)
+		}
+		embeddings, err := GetEmbeddings(inputs)
+		if err != nil {
+			return start, err
+		}
+		for i := range embeddings {
+			chunks[start+i].Embedding = embeddings[i]
+		}
+		err = StoreKnowledgeChunks(groupId, chunks[start:end])
+		if err != nil {
+			return start, err
+		}
+	}
+	return len(chunks), nil
+}
+
+// LoadKnowledgeDirectory imports the .md and .txt files under Directory/<groupId>.
+func LoadKnowledgeDirectory(groupId string) (int, error) {
+	dir := filepath.Join(GlobalConfig.Knowledge.Directory, groupId)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".md" && ext != ".txt") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return total, err
+		}
+		count, err := AddKnowledge(groupId, entry.Name(), string(content))
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// LoadAllKnowledge imports the documents of every group directory at startup.
+func LoadAllKnowledge() {
+	if !GlobalConfig.Knowledge.Enable {
+		return
+	}
+	entries, err := os.ReadDir(GlobalConfig.Knowledge.Directory)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Error("[KnowledgeBase]read directory fail: ", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		count, err := LoadKnowledgeDirectory(entry.Name())
+		if err != nil {
+			logrus.Error("[KnowledgeBase]load documents of group "+entry.Name()+" fail: ", err)
+		}
+		logrus.Infof("[KnowledgeBase]loaded %d new chunks for group %s", count, entry.Name())
+	}
+}
+
+// RetrieveKnowledge returns the chunks of a group most similar to query.
+func RetrieveKnowledge(groupId string, query string) ([]KnowledgeChunk, error) {
+	chunks, err := knowledgeChunks(groupId)
+	if err != nil || len(chunks) == 0 {
+		return nil, err
+	}
+	embedding, err := GetEmbedding(query)
+	if err != nil {
+		return nil, err
+	}
+	similarities := make(map[string]float64, len(chunks))
+	var relevant []KnowledgeChunk
+	for _, chunk := range chunks {
+		similarity := CosineSimilarity(embedding, chunk.Embedding)
+		if similarity >= GlobalConfig.Knowledge.MinSimilarity {
+			similarities[chunk.Id] = similarity
+			relevant = append(relevant, chunk)
+		}
+	}
+	sort.Slice(relevant, func(i, j int) bool {
+		return similarities[relevant[i].Id] > similarities[relevant[j].Id]
+	})
+	if len(relevant) > GlobalConfig.Knowledge.TopK {
+		relevant = relevant[:GlobalConfig.Knowledge.TopK]
+	}
+	return relevant, nil
+}
+
+// InjectKnowledge inserts the knowledge relevant to the last message of the request as system context
+// right before that message. The record itself is left untouched.
+func (req *AIRequest) InjectKnowledge(groupId string) {
+	if !GlobalConfig.Knowledge.Enable || groupId == "" || len(req.Messages) < 2 {
+		return
+	}
+	last := req.Messages[len(req.Messages)-1]
+	chunks, err := RetrieveKnowledge(groupId, last.Content)
+	if err != nil {
+		logrus.Error("[KnowledgeBase]retrieve knowledge fail: ", err)
+		return
+	}
+	if len(chunks) == 0 {
+		return
+	}
+	var knowledge strings.Builder
+	knowledge.WriteString("以下是与用户问题相关的资料，请优先依据这些资料准确回答：")
+	for _, chunk := range chunks {
+		knowledge.WriteString("\n---\n")
+		knowledge.WriteString(chunk.Text)
+	}
+	messages := make([]ChatMessage, 0, len(req.Messages)+1)
+	messages = append(messages, req.Messages[:len(req.Messages)-1]...)
+	messages = append(messages, ChatMessage{Role: "system", Content: knowledge.String()}, last)
+	req.Messages = messages
+}
+
+// ExecuteKnowledgeCommand handles the admin command "NerdBot kb add <text>|load|clear|stats" in groups.
+func (req QQMessage) ExecuteKnowledgeCommand(args []string) string {
+	if !GlobalConfig.Knowledge.Enable {
+		return "[错误]知识库功能未开启"
+	}
+	groupId := strconv.FormatInt(req.GroupId, 10)
+	switch args[0] {
+	case "add":
+		if len(args) < 2 || strings.TrimSpace(args[1]) == "" {
+			return "[错误]用法: NerdBot kb add [文本]"
+		}
+		count, err := AddKnowledge(groupId, "user:"+strconv.FormatInt(req.UserId, 10), args[1])
+		if err != nil {
+			logrus.Error("[KnowledgeBase]add knowledge fail: ", err)
+			return "[错误]知识导入失败"
+		}
+		return fmt.Sprintf("[通知]已导入%d个知识分块", count)
+	case "load":
+		count, err := LoadKnowledgeDirectory(groupId)
+		if err != nil {
+			logrus.Error("[KnowledgeBase]load documents fail: ", err)
+			return fmt.Sprintf("[错误]文档导入失败，已导入%d个知识分块", count)
+		}
+		return fmt.Sprintf("[通知]已从文档目录导入%d个新的知识分块", count)
+	case "clear":
+		err := DeleteKnowledgeBase(groupId)
+		knowledgeChanged(groupId)
+		if err != nil {
+			logrus.Error("[KnowledgeBase]clear knowledge fail: ", err)
+			return "[错误]知识库清除失败"
+		}
+		return "[通知]本群知识库已清除"
+	case "stats":
+		count, err := CountKnowledgeChunks(groupId)
+		if err != nil {
+			logrus.Error("[KnowledgeBase]count knowledge fail: ", err)
+			return "[错误]获取知识库信息失败"
+		}
+		return fmt.Sprintf("[通知]本群知识库共有%d个知识分块", count)
+	}
+	return "[错误]未查询到相应指令，可用: kb add [文本]|load|clear|stats"
+}
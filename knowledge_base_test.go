@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChunkText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		size    int
+		overlap int
+		want    []string
+	}{
+		{"empty", "", 10, 0, nil},
+		{"paragraphs kept together", "abc\n\ndef", 10, 0, []string{"abc\n\ndef"}},
+		{"paragraphs split", "aaaa\n\nbbbb", 6, 0, []string{"aaaa", "bbbb"}},
+		{"windows line endings", "a\r\n\r\nb", 3, 0, []string{"a", "b"}},
+		{"long paragraph with overlap", "abcdefghijkl", 5, 2, []string{"abcde", "defgh", "ghijk", "jkl"}},
+		{"overlap not below size", "abcdef", 3, 3, []string{"abc", "def"}},
+		{"runes", "你好世界再见", 4, 1, []string{"你好世界", "界再见"}},
+		{"default size", "x", 0, 0, []string{"x"}},
+	}
+	for _, tt := range tests {
+		if got := ChunkText(tt.text, tt.size, tt.overlap); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ChunkText(%q, %d, %d) = %q, want %q", tt.name, tt.text, tt.size, tt.overlap, got, tt.want)
+		}
+	}
+}
+
+func TestKnowledgeIndexInvalidation(t *testing.T) {
+	setTestConfig(t, &Config{ServeMode: "onebot"})
+	setTestStore(t)
+	if err := SubscribeKnowledge(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		invalidateKnowledge("1")
+	})
+	count := func() int {
+		t.Helper()
+		chunks, err := knowledgeChunks("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(chunks)
+	}
+	if err := StoreKnowledgeChunks("1", []KnowledgeChunk{{Id: "a", Text: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("chunks = %d, want 1", n)
+	}
+	if err := StoreKnowledgeChunks("1", []KnowledgeChunk{{Id: "b", Text: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("chunks = %d before the change is announced, want the parsed 1", n)
+	}
+	knowledgeChanged("1")
+	if n := count(); n != 2 {
+		t.Errorf("chunks = %d after kb add, want 2", n)
+	}
+	if err := DeleteKnowledgeBase("1"); err != nil {
+		t.Fatal(err)
+	}
+	knowledgeChanged("1")
+	if n := count(); n != 0 {
+		t.Errorf("chunks = %d after kb clear, want 0", n)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"context"
+	"crypto/subtle"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -20,16 +22,34 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 	initHTTPClients()
-	InitRedis()
+	err = InitModeration()
+	if err != nil {
+		logrus.Error("initiate moderation fail: ", err)
+		return
+	}
+	err = InitStorage()
+	if err != nil {
+		logrus.Error("initiate storage fail: ", err)
+		return
+	}
 	defer func() {
-		if err := Connection.FlushAll(context.Background()).Err(); err != nil {
-			logrus.Fatalf("goredis - failed to flush: %v", err)
+		if err := Store.Close(); err != nil {
+			logrus.Error("close storage fail: ", err)
 		}
-		if err := Connection.Close(); err != nil {
-			logrus.Fatalf("goredis - failed to communicate to redis-server: %v", err)
+		if Auditor != nil {
+			Auditor.Close()
 		}
 	}()
-	go DailyPromptsClear()
+	err = InitAudit()
+	if err != nil {
+		logrus.Error("initiate audit log fail: ", err)
+		return
+	}
+	err = StartRetentionSchedules()
+	if err != nil {
+		logrus.Error("initiate retention schedules fail: ", err)
+		return
+	}
 	if GlobalConfig.ServeMode == "onebot" {
 		oneBotServe()
 	} else {
@@ -37,7 +57,33 @@ func main() {
 	}
 }
 
+// initKeySchema migrates the stored keys once the identity of the bot, which is part of every key, is known.
+func initKeySchema() error {
+	err := MigrateKeys()
+	if err != nil {
+		return err
+	}
+	err = SubscribeGroupSettings()
+	if err != nil {
+		return err
+	}
+	err = SubscribeKnowledge()
+	if err != nil {
+		return err
+	}
+	go LoadAllKnowledge()
+	return nil
+}
+
 func openWechatServe() {
+	if err := InitCommandAliases(); err != nil {
+		logrus.Error("initiate command aliases fail: ", err)
+		return
+	}
+	if err := initKeySchema(); err != nil {
+		logrus.Error("migrate redis keys fail: ", err)
+		return
+	}
 	http.Handle("/", OpenWechatHandler{})
 	logrus.Info("listening to: ", GlobalConfig.Server.Address)
 	err := http.ListenAndServe(GlobalConfig.Server.Address, nil)
@@ -54,10 +100,31 @@ func oneBotServe() {
 		return
 	}
 	GlobalConfig.OneBot11.SelfId = loginInfo.Data.UserId
+	GlobalConfig.OneBot11.SelfNickname = loginInfo.Data.Nickname
+	err = InitCommandAliases()
+	if err != nil {
+		logrus.Error("initiate command aliases fail: ", err)
+		return
+	}
+	if err = initKeySchema(); err != nil {
+		logrus.Error("migrate redis keys fail: ", err)
+		return
+	}
 	gin.SetMode(gin.ReleaseMode)
 	gin.DefaultWriter = io.Discard
 	r := gin.Default()
+	Events = NewEventQueue(GlobalConfig.EventQueue, handleEvent)
+	Events.Start()
 	r.POST("/", reply)
+	if GlobalConfig.Server.Metrics {
+		r.GET("/metrics", func(ctx *gin.Context) {
+			if !metricsAuthorized(ctx.Request) {
+				ctx.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			ctx.JSON(http.StatusOK, Events.Stats())
+		})
+	}
 	if GlobalConfig.OneBot11.HeartbeatTimeOut > 0 {
 		HeartbeatContinue()
 		go HeartBeatMonitor()
@@ -73,6 +140,20 @@ func oneBotServe() {
 	}
 }
 
+// metricsAuthorized reports whether the request carries the OneBot access token, either as a bearer token
+// or as the access_token query parameter like OneBot does.
+func metricsAuthorized(req *http.Request) bool {
+	token := GlobalConfig.OneBot11.AccessToken
+	if token == "" {
+		return true
+	}
+	given := req.URL.Query().Get("access_token")
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
 func initHTTPClients() {
 	OneBotClient = &http.Client{
 		Transport: &OneBotTokenTransport{
@@ -85,5 +166,6 @@ func initHTTPClients() {
 			Token: GlobalConfig.AI.APIKey,
 			Base:  http.DefaultTransport,
 		},
+		Timeout: time.Duration(GlobalConfig.AI.RequestTimeout) * time.Second,
 	}
 }
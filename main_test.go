@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+// setTestConfig replaces GlobalConfig for the duration of a test.
+func setTestConfig(t *testing.T, config *Config) {
+	t.Helper()
+	previous := GlobalConfig
+	GlobalConfig = config
+	t.Cleanup(func() {
+		GlobalConfig = previous
+	})
+}
+
+// setTestStore replaces Store by an empty memory storage for the duration of a test.
+func setTestStore(t *testing.T) *MemoryStorage {
+	t.Helper()
+	previous := Store
+	store := NewMemoryStorage()
+	Store = store
+	t.Cleanup(func() {
+		Store = previous
+		store.Close()
+	})
+	return store
+}
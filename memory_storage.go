@@ -0,0 +1,687 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	Kind     string             `json:"kind"`
+	String   string             `json:"string,omitempty"`
+	Hash     map[string]string  `json:"hash,omitempty"`
+	Set      map[string]bool    `json:"set,omitempty"`
+	ZSet     map[string]float64 `json:"zset,omitempty"`
+	ExpireAt time.Time          `json:"expireAt"`
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.ExpireAt.IsZero() && !now.Before(e.ExpireAt)
+}
+
+// memoryStore holds the data of a MemoryStorage and all views of it.
+type memoryStore struct {
+	mu       sync.Mutex
+	entries  map[string]*memoryEntry
+	versions map[string]uint64
+	// dirty collects the keys modified while the lock is held
+	dirty []string
+	// persist, if set, is called with the modified keys before the lock is released
+	persist func(entries map[string]*memoryEntry, keys []string) error
+	close   func() error
+	done    chan struct{}
+
+	subscribersMu sync.RWMutex
+	subscribers   map[string][]func(message string)
+}
+
+// MemoryStorage keeps the state in the memory of the process. It is lost on exit unless the storage was
+// opened by NewFileStorage.
+type MemoryStorage struct {
+	store   *memoryStore
+	locked  bool
+	watched map[string]uint64
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	store := &memoryStore{
+		entries:     make(map[string]*memoryEntry),
+		versions:    make(map[string]uint64),
+		done:        make(chan struct{}),
+		subscribers: make(map[string][]func(message string)),
+	}
+	go store.sweep()
+	return &MemoryStorage{store: store}
+}
+
+// sweep removes expired entries every minute, entries are otherwise only removed when accessed.
+func (m *memoryStore) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for key, e := range m.entries {
+				if e.expired(now) {
+					m.remove(key)
+				}
+			}
+			m.flush()
+			m.mu.Unlock()
+		}
+	}
+}
+
+func (m *memoryStore) touch(key string) {
+	m.versions[key]++
+	m.dirty = append(m.dirty, key)
+}
+
+func (m *memoryStore) remove(key string) {
+	delete(m.entries, key)
+	m.touch(key)
+}
+
+// flush hands the modified keys to persist. It is called with the lock held.
+func (m *memoryStore) flush() error {
+	if len(m.dirty) == 0 {
+		return nil
+	}
+	keys := m.dirty
+	m.dirty = nil
+	if m.persist == nil {
+		return nil
+	}
+	return m.persist(m.entries, keys)
+}
+
+// lookup returns the entry of key, or nil if it does not exist or has expired.
+func (m *memoryStore) lookup(key string) *memoryEntry {
+	e := m.entries[key]
+	if e == nil {
+		return nil
+	}
+	if e.expired(time.Now()) {
+		m.remove(key)
+		return nil
+	}
+	return e
+}
+
+// entry returns the entry of key if it holds the given kind of value. With create, a missing entry is created.
+func (m *memoryStore) entry(key string, kind string, create bool) (*memoryEntry, error) {
+	e := m.lookup(key)
+	if e == nil {
+		if !create {
+			return nil, nil
+		}
+		e = &memoryEntry{Kind: kind}
+		switch kind {
+		case "hash":
+			e.Hash = make(map[string]string)
+		case "set":
+			e.Set = make(map[string]bool)
+		case "zset":
+			e.ZSet = make(map[string]float64)
+		}
+		m.entries[key] = e
+	}
+	if e.Kind != kind {
+		return nil, ErrWrongType
+	}
+	return e, nil
+}
+
+func expireAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// do runs fn with the lock held. Inside a transaction the lock is already held by Pipelined.
+func (s *MemoryStorage) do(fn func(m *memoryStore) error) error {
+	if s.locked {
+		return fn(s.store)
+	}
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	err := fn(s.store)
+	if flushErr := s.store.flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func (s *MemoryStorage) Get(key string) (string, error) {
+	var value string
+	err := s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "string", false)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			return ErrKeyNotFound
+		}
+		value = e.String
+		return nil
+	})
+	return value, err
+}
+
+func (s *MemoryStorage) Set(key string, value string, ttl time.Duration) error {
+	return s.do(func(m *memoryStore) error {
+		m.entries[key] = &memoryEntry{Kind: "string", String: value, ExpireAt: expireAt(ttl)}
+		m.touch(key)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	var ok bool
+	err := s.do(func(m *memoryStore) error {
+		if m.lookup(key) != nil {
+			return nil
+		}
+		m.entries[key] = &memoryEntry{Kind: "string", String: value, ExpireAt: expireAt(ttl)}
+		m.touch(key)
+		ok = true
+		return nil
+	})
+	return ok, err
+}
+
+func (s *MemoryStorage) Del(keys ...string) error {
+	return s.do(func(m *memoryStore) error {
+		for _, key := range keys {
+			if m.lookup(key) != nil {
+				m.remove(key)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *MemoryStorage) Exists(key string) (bool, error) {
+	var exists bool
+	err := s.do(func(m *memoryStore) error {
+		exists = m.lookup(key) != nil
+		return nil
+	})
+	return exists, err
+}
+
+func (s *MemoryStorage) rename(key string, newKey string, nx bool) (bool, error) {
+	var ok bool
+	err := s.do(func(m *memoryStore) error {
+		e := m.lookup(key)
+		if e == nil {
+			return ErrKeyNotFound
+		}
+		if nx && m.lookup(newKey) != nil {
+			return nil
+		}
+		m.remove(key)
+		m.entries[newKey] = e
+		m.touch(newKey)
+		ok = true
+		return nil
+	})
+	return ok, err
+}
+
+func (s *MemoryStorage) Rename(key string, newKey string) error {
+	_, err := s.rename(key, newKey, false)
+	return err
+}
+
+func (s *MemoryStorage) RenameNX(key string, newKey string) (bool, error) {
+	return s.rename(key, newKey, true)
+}
+
+// Expire sets the time to live of key. Like in Redis, a ttl that is not positive deletes the key.
+func (s *MemoryStorage) Expire(key string, ttl time.Duration) error {
+	return s.do(func(m *memoryStore) error {
+		e := m.lookup(key)
+		if e == nil {
+			return nil
+		}
+		if ttl <= 0 {
+			m.remove(key)
+			return nil
+		}
+		e.ExpireAt = expireAt(ttl)
+		m.touch(key)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) Scan(pattern string) ([]string, error) {
+	var keys []string
+	err := s.do(func(m *memoryStore) error {
+		now := time.Now()
+		for key, e := range m.entries {
+			if e.expired(now) {
+				continue
+			}
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (s *MemoryStorage) HSet(key string, values map[string]string) error {
+	return s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "hash", true)
+		if err != nil {
+			return err
+		}
+		for field, value := range values {
+			e.Hash[field] = value
+		}
+		m.touch(key)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) HGetAll(key string) (map[string]string, error) {
+	values := make(map[string]string)
+	err := s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "hash", false)
+		if e == nil {
+			return err
+		}
+		for field, value := range e.Hash {
+			values[field] = value
+		}
+		return nil
+	})
+	return values, err
+}
+
+func (s *MemoryStorage) HDel(key string, fields ...string) error {
+	return s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "hash", false)
+		if e == nil {
+			return err
+		}
+		for _, field := range fields {
+			delete(e.Hash, field)
+		}
+		if len(e.Hash) == 0 {
+			m.remove(key)
+		} else {
+			m.touch(key)
+		}
+		return nil
+	})
+}
+
+func (s *MemoryStorage) HLen(key string) (int64, error) {
+	var count int64
+	err := s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "hash", false)
+		if e == nil {
+			return err
+		}
+		count = int64(len(e.Hash))
+		return nil
+	})
+	return count, err
+}
+
+func (s *MemoryStorage) HExists(key string, field string) (bool, error) {
+	var exists bool
+	err := s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "hash", false)
+		if e == nil {
+			return err
+		}
+		_, exists = e.Hash[field]
+		return nil
+	})
+	return exists, err
+}
+
+func (s *MemoryStorage) HIncrBy(key string, field string, incr int64) error {
+	return s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "hash", true)
+		if err != nil {
+			return err
+		}
+		var value int64
+		if e.Hash[field] != "" {
+			value, err = strconv.ParseInt(e.Hash[field], 10, 64)
+			if err != nil {
+				return errors.New("storage: hash value is not an integer")
+			}
+		}
+		e.Hash[field] = strconv.FormatInt(value+incr, 10)
+		m.touch(key)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) HIncrByFloat(key string, field string, incr float64) error {
+	return s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "hash", true)
+		if err != nil {
+			return err
+		}
+		var value float64
+		if e.Hash[field] != "" {
+			value, err = strconv.ParseFloat(e.Hash[field], 64)
+			if err != nil {
+				return errors.New("storage: hash value is not a float")
+			}
+		}
+		e.Hash[field] = strconv.FormatFloat(value+incr, 'f', -1, 64)
+		m.touch(key)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) SAdd(key string, members ...string) error {
+	return s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "set", true)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			e.Set[member] = true
+		}
+		m.touch(key)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) SRem(key string, members ...string) error {
+	return s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "set", false)
+		if e == nil {
+			return err
+		}
+		for _, member := range members {
+			delete(e.Set, member)
+		}
+		if len(e.Set) == 0 {
+			m.remove(key)
+		} else {
+			m.touch(key)
+		}
+		return nil
+	})
+}
+
+func (s *MemoryStorage) SIsMember(key string, member string) (bool, error) {
+	var exists bool
+	err := s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "set", false)
+		if e == nil {
+			return err
+		}
+		exists = e.Set[member]
+		return nil
+	})
+	return exists, err
+}
+
+func (s *MemoryStorage) SMembers(key string) ([]string, error) {
+	var members []string
+	err := s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "set", false)
+		if e == nil {
+			return err
+		}
+		for member := range e.Set {
+			members = append(members, member)
+		}
+		return nil
+	})
+	sort.Strings(members)
+	return members, err
+}
+
+func (s *MemoryStorage) ZIncrBy(key string, member string, incr float64) error {
+	return s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "zset", true)
+		if err != nil {
+			return err
+		}
+		e.ZSet[member] += incr
+		m.touch(key)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) ZRevRange(key string, n int64) ([]ScoredMember, error) {
+	var members []ScoredMember
+	err := s.do(func(m *memoryStore) error {
+		e, err := m.entry(key, "zset", false)
+		if e == nil {
+			return err
+		}
+		for member, score := range e.ZSet {
+			members = append(members, ScoredMember{Member: member, Score: score})
+		}
+		return nil
+	})
+	// same order as ZREVRANGE: by score, then by member, both descending
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score > members[j].Score
+		}
+		return members[i].Member > members[j].Member
+	})
+	if int64(len(members)) > n {
+		members = members[:n]
+	}
+	return members, err
+}
+
+// Pipelined queues the writes of fn and applies them only if fn succeeds, like the commands of a Redis
+// MULTI, so a failing transaction leaves the storage as it was. As with EXEC, a write that fails when it is
+// applied does not undo the writes before it.
+func (s *MemoryStorage) Pipelined(fn func(pipe Storage) error) error {
+	if s.locked {
+		return fn(s)
+	}
+	return s.do(func(m *memoryStore) error {
+		for key, version := range s.watched {
+			if m.versions[key] != version {
+				return ErrTxConflict
+			}
+		}
+		pipe := &memoryPipeline{MemoryStorage: &MemoryStorage{store: m, locked: true}}
+		if err := fn(pipe); err != nil {
+			return err
+		}
+		for _, write := range pipe.writes {
+			if err := write(pipe.MemoryStorage); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *MemoryStorage) Watch(fn func(tx Storage) error, keys ...string) error {
+	watched := make(map[string]uint64, len(keys))
+	err := s.do(func(m *memoryStore) error {
+		for _, key := range keys {
+			m.lookup(key)
+			watched[key] = m.versions[key]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fn(&MemoryStorage{store: s.store, watched: watched})
+}
+
+// Publish calls the subscribers of channel directly, as there are no other instances sharing the storage.
+func (s *MemoryStorage) Publish(channel string, message string) error {
+	s.store.subscribersMu.RLock()
+	handlers := s.store.subscribers[channel]
+	s.store.subscribersMu.RUnlock()
+	for _, handler := range handlers {
+		handler(message)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Subscribe(channel string, handler func(message string)) error {
+	s.store.subscribersMu.Lock()
+	defer s.store.subscribersMu.Unlock()
+	s.store.subscribers[channel] = append(s.store.subscribers[channel], handler)
+	return nil
+}
+
+// TakeTokens implements the same token buckets as the Lua script of RedisStorage.
+func (s *MemoryStorage) TakeTokens(keys []string, limits []BucketLimit, now time.Time) (int, time.Duration, error) {
+	rejected, retryAfter := -1, time.Duration(0)
+	err := s.do(func(m *memoryStore) error {
+		tokens := make([]float64, len(keys))
+		for i, key := range keys {
+			e, err := m.entry(key, "hash", false)
+			if err != nil {
+				return err
+			}
+			last, ts := float64(limits[i].Burst), float64(now.UnixMilli())
+			if e != nil {
+				if value, err := strconv.ParseFloat(e.Hash["tokens"], 64); err == nil {
+					last = value
+				}
+				if value, err := strconv.ParseFloat(e.Hash["ts"], 64); err == nil {
+					ts = value
+				}
+			}
+			elapsed := math.Max(0, float64(now.UnixMilli())-ts)
+			last = math.Min(float64(limits[i].Burst), last+elapsed/1000*limits[i].Rate)
+			if last < 1 {
+				rejected = i
+				retryAfter = time.Duration(math.Ceil((1-last)/limits[i].Rate*1000)) * time.Millisecond
+				return nil
+			}
+			tokens[i] = last
+		}
+		for i, key := range keys {
+			m.entries[key] = &memoryEntry{
+				Kind: "hash",
+				Hash: map[string]string{
+					"tokens": strconv.FormatFloat(tokens[i]-1, 'f', -1, 64),
+					"ts":     strconv.FormatInt(now.UnixMilli(), 10),
+				},
+				// like PEXPIRE of the script, the time to live counts from the clock of the storage
+				ExpireAt: expireAt(time.Duration(math.Ceil(float64(limits[i].Burst)/limits[i].Rate*1000)) * time.Millisecond),
+			}
+			m.touch(key)
+		}
+		return nil
+	})
+	return rejected, retryAfter, err
+}
+
+func (s *MemoryStorage) Close() error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	select {
+	case <-s.store.done:
+		return nil
+	default:
+		close(s.store.done)
+	}
+	if s.store.close != nil {
+		return s.store.close()
+	}
+	return nil
+}
+
+// memoryPipeline queues the writes of a transaction until Pipelined applies them. Reads see the storage as
+// it is, without the queued writes, and the results of writes are not known before they are applied.
+type memoryPipeline struct {
+	*MemoryStorage
+	writes []func(s *MemoryStorage) error
+}
+
+func (p *memoryPipeline) queue(write func(s *MemoryStorage) error) error {
+	p.writes = append(p.writes, write)
+	return nil
+}
+
+func (p *memoryPipeline) Set(key string, value string, ttl time.Duration) error {
+	return p.queue(func(s *MemoryStorage) error { return s.Set(key, value, ttl) })
+}
+
+func (p *memoryPipeline) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	return false, p.queue(func(s *MemoryStorage) error {
+		_, err := s.SetNX(key, value, ttl)
+		return err
+	})
+}
+
+func (p *memoryPipeline) Del(keys ...string) error {
+	return p.queue(func(s *MemoryStorage) error { return s.Del(keys...) })
+}
+
+func (p *memoryPipeline) Rename(key string, newKey string) error {
+	return p.queue(func(s *MemoryStorage) error { return s.Rename(key, newKey) })
+}
+
+func (p *memoryPipeline) RenameNX(key string, newKey string) (bool, error) {
+	return false, p.queue(func(s *MemoryStorage) error {
+		_, err := s.RenameNX(key, newKey)
+		return err
+	})
+}
+
+func (p *memoryPipeline) Expire(key string, ttl time.Duration) error {
+	return p.queue(func(s *MemoryStorage) error { return s.Expire(key, ttl) })
+}
+
+func (p *memoryPipeline) HSet(key string, values map[string]string) error {
+	return p.queue(func(s *MemoryStorage) error { return s.HSet(key, values) })
+}
+
+func (p *memoryPipeline) HDel(key string, fields ...string) error {
+	return p.queue(func(s *MemoryStorage) error { return s.HDel(key, fields...) })
+}
+
+func (p *memoryPipeline) HIncrBy(key string, field string, incr int64) error {
+	return p.queue(func(s *MemoryStorage) error { return s.HIncrBy(key, field, incr) })
+}
+
+func (p *memoryPipeline) HIncrByFloat(key string, field string, incr float64) error {
+	return p.queue(func(s *MemoryStorage) error { return s.HIncrByFloat(key, field, incr) })
+}
+
+func (p *memoryPipeline) SAdd(key string, members ...string) error {
+	return p.queue(func(s *MemoryStorage) error { return s.SAdd(key, members...) })
+}
+
+func (p *memoryPipeline) SRem(key string, members ...string) error {
+	return p.queue(func(s *MemoryStorage) error { return s.SRem(key, members...) })
+}
+
+func (p *memoryPipeline) ZIncrBy(key string, member string, incr float64) error {
+	return p.queue(func(s *MemoryStorage) error { return s.ZIncrBy(key, member, incr) })
+}
+
+func (p *memoryPipeline) Publish(channel string, message string) error {
+	return p.queue(func(s *MemoryStorage) error { return s.Publish(channel, message) })
+}
+
+func (p *memoryPipeline) Pipelined(fn func(pipe Storage) error) error {
+	return fn(p)
+}
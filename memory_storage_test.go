@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errAbort = errors.New("abort")
+
+func TestMemoryStorageWatchConflict(t *testing.T) {
+	store := NewMemoryStorage()
+	defer store.Close()
+	if err := store.Set("key", "old", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	err := store.Watch(func(tx Storage) error {
+		// another client changes the watched key before the transaction runs
+		if err := store.Set("key", "other", 0); err != nil {
+			return err
+		}
+		return tx.Pipelined(func(pipe Storage) error {
+			return pipe.Set("key", "new", 0)
+		})
+	}, "key")
+	if err != ErrTxConflict {
+		t.Fatalf("Watch() error = %v, want ErrTxConflict", err)
+	}
+	if value, _ := store.Get("key"); value != "other" {
+		t.Errorf("key = %q after conflict, want %q", value, "other")
+	}
+
+	err = store.Watch(func(tx Storage) error {
+		return tx.Pipelined(func(pipe Storage) error {
+			return pipe.Set("key", "new", 0)
+		})
+	}, "key")
+	if err != nil {
+		t.Fatalf("Watch() error = %v, want nil", err)
+	}
+	if value, _ := store.Get("key"); value != "new" {
+		t.Errorf("key = %q, want %q", value, "new")
+	}
+}
+
+func TestMemoryStoragePipelinedAtomic(t *testing.T) {
+	store := NewMemoryStorage()
+	defer store.Close()
+
+	err := store.Pipelined(func(pipe Storage) error {
+		if err := pipe.Set("a", "1", 0); err != nil {
+			return err
+		}
+		if err := pipe.HIncrBy("b", "count", 1); err != nil {
+			return err
+		}
+		if err := pipe.SAdd("c", "member"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Pipelined() error = %v, want errAbort", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if exists, _ := store.Exists(key); exists {
+			t.Errorf("%s exists after a failed transaction", key)
+		}
+	}
+
+	err = store.Pipelined(func(pipe Storage) error {
+		if err := pipe.Set("a", "1", 0); err != nil {
+			return err
+		}
+		return pipe.HIncrBy("b", "count", 2)
+	})
+	if err != nil {
+		t.Fatalf("Pipelined() error = %v, want nil", err)
+	}
+	if value, _ := store.Get("a"); value != "1" {
+		t.Errorf("a = %q, want %q", value, "1")
+	}
+	if values, _ := store.HGetAll("b"); values["count"] != "2" {
+		t.Errorf("b.count = %q, want %q", values["count"], "2")
+	}
+}
+
+func TestFileStoragePipelinedAtomic(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nerdbot.db")
+	store, err := NewFileStorage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Pipelined(func(pipe Storage) error {
+		if err := pipe.Set("a", "1", 0); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Pipelined() error = %v, want errAbort", err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewFileStorage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if exists, _ := store.Exists("a"); exists {
+		t.Error("a was persisted by a failed transaction")
+	}
+}
+
+func TestMemoryStorageTakeTokens(t *testing.T) {
+	store := NewMemoryStorage()
+	defer store.Close()
+	now := time.UnixMilli(1_700_000_000_000)
+	keys := []string{"user", "global"}
+	limits := []BucketLimit{{Rate: 1, Burst: 2}, {Rate: 10, Burst: 3}}
+
+	for i := 0; i < 2; i++ {
+		rejected, _, err := store.TakeTokens(keys, limits, now)
+		if err != nil || rejected != -1 {
+			t.Fatalf("take %d: rejected = %d, err = %v, want -1, nil", i, rejected, err)
+		}
+	}
+	rejected, retryAfter, err := store.TakeTokens(keys, limits, now)
+	if err != nil || rejected != 0 {
+		t.Fatalf("take 3: rejected = %d, err = %v, want 0, nil", rejected, err)
+	}
+	if retryAfter != time.Second {
+		t.Errorf("retryAfter = %v, want 1s", retryAfter)
+	}
+	// the rejected take must not consume the token of the other bucket
+	if values, _ := store.HGetAll("global"); values["tokens"] != "1" {
+		t.Errorf("global tokens = %q, want %q", values["tokens"], "1")
+	}
+
+	rejected, _, err = store.TakeTokens(keys, limits, now.Add(time.Second))
+	if err != nil || rejected != -1 {
+		t.Fatalf("take after refill: rejected = %d, err = %v, want -1, nil", rejected, err)
+	}
+	if values, _ := store.HGetAll("user"); values["tokens"] != "0" {
+		t.Errorf("user tokens = %q, want %q", values["tokens"], "0")
+	}
+}
+
+func TestFileStorageRollsBackFailedWrites(t *testing.T) {
+	store, err := NewFileStorage(filepath.Join(t.TempDir(), "nerdbot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err = store.Set("a", "old", 0); err != nil {
+		t.Fatal(err)
+	}
+	err = store.Pipelined(func(pipe Storage) error {
+		if err := pipe.Set("a", "new", 0); err != nil {
+			return err
+		}
+		if err := pipe.Set("b", "new", 0); err != nil {
+			return err
+		}
+		// bbolt rejects empty keys, so the file cannot be written
+		return pipe.Set("", "new", 0)
+	})
+	if err == nil {
+		t.Fatal("Pipelined() error = nil, want the error of the file")
+	}
+	if value, _ := store.Get("a"); value != "old" {
+		t.Errorf("a = %q after a failed write, want %q", value, "old")
+	}
+	for _, key := range []string{"b", ""} {
+		if exists, _ := store.Exists(key); exists {
+			t.Errorf("%q exists after a failed write", key)
+		}
+	}
+}
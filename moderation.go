@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrMessageRejected is returned when a message is refused and the refusal has already been handled.
+var ErrMessageRejected = errors.New("message rejected")
+
+var sensitiveWords *AhoCorasick
+
+type ModerationResult struct {
+	Flagged bool
+	Reasons []string
+	// Masked is the text with every dictionary match replaced by '*'
+	Masked string
+	// Maskable is false if the text was flagged by OpenAI, which reports no positions to mask
+	Maskable bool
+}
+
+type openAIModerationResponse struct {
+	Results []struct {
+		Flagged    bool            `json:"flagged"`
+		Categories map[string]bool `json:"categories"`
+	} `json:"results"`
+}
+
+func InitModeration() error {
+	if !GlobalConfig.Moderation.Enable || GlobalConfig.Moderation.DictionaryFile == "" {
+		return nil
+	}
+	file, err := os.Open(GlobalConfig.Moderation.DictionaryFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	sensitiveWords = NewAhoCorasick(words)
+	logrus.Info("load sensitive words success: ", len(words))
+	return nil
+}
+
+func Moderate(text string) ModerationResult {
+	result := ModerationResult{Masked: text, Maskable: true}
+	if !GlobalConfig.Moderation.Enable {
+		return result
+	}
+	if sensitiveWords != nil {
+		runes := []rune(text)
+		matches := sensitiveWords.FindAll(runes)
+		for _, match := range matches {
+			result.Reasons = append(result.Reasons, string(runes[match[0]:match[1]]))
+		}
+		for _, match := range matches {
+			for i := match[0]; i < match[1]; i++ {
+				runes[i] = '*'
+			}
+		}
+		if len(matches) > 0 {
+			result.Flagged = true
+			result.Masked = string(runes)
+		}
+	}
+	if GlobalConfig.Moderation.EnableOpenAI {
+		categories, err := openAIModerate(text)
+		if err != nil {
+			logrus.Error("OpenAI moderation fail: ", err)
+		} else if len(categories) > 0 {
+			result.Flagged = true
+			result.Maskable = false
+			result.Reasons = append(result.Reasons, categories...)
+		}
+	}
+	return result
+}
+
+// openAIModerate returns the flagged categories of text, or nil if it is not flagged.
+func openAIModerate(text string) ([]string, error) {
+	body, err := json.Marshal(map[string]string{"input": text})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", GlobalConfig.Moderation.ModerationUrl, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := AIClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("moderation API error %d: %s", resp.StatusCode, responseBody)
+	}
+	var moderationResp openAIModerationResponse
+	err = json.Unmarshal(responseBody, &moderationResp)
+	if err != nil {
+		return nil, err
+	}
+	var categories []string
+	for _, result := range moderationResp.Results {
+		if !result.Flagged {
+			continue
+		}
+		for category, flagged := range result.Categories {
+			if flagged {
+				categories = append(categories, category)
+			}
+		}
+		if len(categories) == 0 {
+			categories = append(categories, "flagged")
+		}
+	}
+	return categories, nil
+}
+
+// ModerateText runs text through the moderation pipeline and applies the configured action of the
+// given direction ("input" or "output"). It returns the text to use and whether it may be used at all.
+func (data *SendMsgData) ModerateText(text string, direction string) (string, bool) {
+	result := Moderate(text)
+	if !result.Flagged {
+		return text, true
+	}
+	action := GlobalConfig.Moderation.InputAction
+	if direction == "output" {
+		action = GlobalConfig.Moderation.OutputAction
+	}
+	logrus.Warnf("[Moderation]%s of %s %s/%s flagged (%s): %s", direction, data.MessageType, data.UserId, data.GroupId,
+		strings.Join(result.Reasons, ","), action)
+	if action == "notify" || GlobalConfig.Moderation.NotifyAdmins {
+		data.notifyAdmins(text, direction, result.Reasons)
+	}
+	switch action {
+	case "notify":
+		return text, true
+	case "mask":
+		if result.Maskable {
+			return result.Masked, true
+		}
+	}
+	return "", false
+}
+
+func (data *SendMsgData) notifyAdmins(text string, direction string, reasons []string) {
+	if GlobalConfig.ServeMode != "onebot" {
+		return
+	}
+	source := "私聊"
+	if data.MessageType == "group" {
+		source = "群" + data.GroupId
+	}
+	var subject = "用户" + data.UserId + "的消息"
+	if direction == "output" {
+		subject = "对用户" + data.UserId + "的AI回复"
+	}
+	for _, adminId := range GlobalConfig.Server.AdminIds {
+		notice := SendMsgData{
+			MessageType: "private",
+			UserId:      strconv.FormatInt(adminId, 10),
+			Message: []Message{{
+				Type: "text",
+				Data: map[string]interface{}{
+					"text": fmt.Sprintf("[审核]%s中%s命中敏感内容(%s):\n%s", source, subject, strings.Join(reasons, ","), text),
+				},
+			}},
+			AutoEscape: true,
+		}
+		err := notice.Send()
+		if err != nil {
+			logrus.Error("notify admin fail: ", err)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 var OneBotClient *http.Client
@@ -60,6 +63,27 @@ type LoginInfo struct {
 		Nickname string `json:"nickname"`
 	} `json:"data"`
 }
+type StrangerInfo struct {
+	Retcode int64  `json:"retcode"`
+	Status  string `json:"status"`
+	Data    struct {
+		UserId   int64  `json:"user_id"`
+		Nickname string `json:"nickname"`
+	} `json:"data"`
+}
+type MsgInfo struct {
+	Retcode int64  `json:"retcode"`
+	Status  string `json:"status"`
+	Data    struct {
+		MessageId int64 `json:"message_id"`
+		Sender    struct {
+			UserId   int64  `json:"user_id"`
+			Nickname string `json:"nickname"`
+		} `json:"sender"`
+		// Message is either a CQ code string or an array of segments, depending on the post format
+		Message json.RawMessage `json:"message"`
+	} `json:"data"`
+}
 type GroupMemberInfo struct {
 	Retcode int64  `json:"retcode"`
 	Status  string `json:"status"`
@@ -77,10 +101,10 @@ func GetGroupList() ([]GroupInfoData, error) {
 		return nil, err
 	}
 	resp, err := OneBotClient.Do(req)
-	defer resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -98,10 +122,10 @@ func GetFriendList() ([]FriendInfoData, error) {
 		return nil, err
 	}
 	resp, err := OneBotClient.Do(req)
-	defer resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -119,10 +143,10 @@ func GetLoginInfo() (LoginInfo, error) {
 		return LoginInfo{}, err
 	}
 	resp, err := OneBotClient.Do(req)
-	defer resp.Body.Close()
 	if err != nil {
 		return LoginInfo{}, err
 	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return LoginInfo{}, err
@@ -144,10 +168,10 @@ func GetGroupMemberInfo(userId string, groupId string) (GroupMemberInfo, error)
 		return GroupMemberInfo{}, err
 	}
 	resp, err := OneBotClient.Do(req)
-	defer resp.Body.Close()
 	if err != nil {
 		return GroupMemberInfo{}, err
 	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return GroupMemberInfo{}, err
@@ -168,10 +192,10 @@ func GetGroupInfo(groupId int64) (GroupInfo, error) {
 		return GroupInfo{}, err
 	}
 	resp, err := OneBotClient.Do(req)
-	defer resp.Body.Close()
 	if err != nil {
 		return GroupInfo{}, err
 	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return GroupInfo{}, err
@@ -181,3 +205,141 @@ func GetGroupInfo(groupId int64) (GroupInfo, error) {
 	err = json.Unmarshal(body, &respData)
 	return respData, err
 }
+
+func GetStrangerInfo(userId string) (StrangerInfo, error) {
+	requestUrl := GlobalConfig.OneBot11.ServerUrl + "get_stranger_info"
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return StrangerInfo{}, err
+	}
+	q := req.URL.Query()
+	q.Add("user_id", userId)
+	req.URL.RawQuery = q.Encode()
+	resp, err := OneBotClient.Do(req)
+	if err != nil {
+		return StrangerInfo{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return StrangerInfo{}, err
+	}
+	logrus.Info("Get stranger info success: " + string(body))
+	var respData StrangerInfo
+	err = json.Unmarshal(body, &respData)
+	return respData, err
+}
+
+type ActionResponse struct {
+	Retcode int64  `json:"retcode"`
+	Status  string `json:"status"`
+	Msg     string `json:"msg"`
+	Wording string `json:"wording"`
+}
+
+// CallAction posts params to a OneBot action and checks its return code.
+func CallAction(action string, params interface{}) error {
+	requestUrl := GlobalConfig.OneBot11.ServerUrl + action
+	bytesData, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", requestUrl, bytes.NewReader(bytesData))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json; charset=utf-8")
+	resp, err := OneBotClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var respData ActionResponse
+	err = json.Unmarshal(body, &respData)
+	if err != nil {
+		return err
+	}
+	if respData.Retcode != 0 {
+		return errors.New(action + " fail: " + respData.Msg + " " + respData.Wording)
+	}
+	logrus.Info(action + " success")
+	return nil
+}
+
+// UploadFile uploads a local file of the OneBot host to a private chat or a group.
+func UploadFile(messageType string, userId string, groupId string, file string, name string) error {
+	if messageType == "group" {
+		return CallAction("upload_group_file", map[string]string{"group_id": groupId, "file": file, "name": name})
+	}
+	return CallAction("upload_private_file", map[string]string{"user_id": userId, "file": file, "name": name})
+}
+
+// ForwardNode builds a node of a merged forward message.
+func ForwardNode(name string, uin string, content string) Message {
+	return Message{
+		Type: "node",
+		Data: map[string]interface{}{
+			"name":    name,
+			"uin":     uin,
+			"content": content,
+		},
+	}
+}
+
+func SendForwardMsg(messageType string, userId string, groupId string, nodes []Message) error {
+	if messageType == "group" {
+		return CallAction("send_group_forward_msg", map[string]interface{}{"group_id": groupId, "messages": nodes})
+	}
+	return CallAction("send_private_forward_msg", map[string]interface{}{"user_id": userId, "messages": nodes})
+}
+
+func GetMsg(messageId string) (MsgInfo, error) {
+	requestUrl := GlobalConfig.OneBot11.ServerUrl + "get_msg"
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return MsgInfo{}, err
+	}
+	q := req.URL.Query()
+	q.Add("message_id", messageId)
+	req.URL.RawQuery = q.Encode()
+	resp, err := OneBotClient.Do(req)
+	if err != nil {
+		return MsgInfo{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return MsgInfo{}, err
+	}
+	logrus.Info("Get msg success: " + string(body))
+	var respData MsgInfo
+	err = json.Unmarshal(body, &respData)
+	if err == nil && respData.Retcode != 0 {
+		err = errors.New("get_msg fail: " + respData.Status)
+	}
+	return respData, err
+}
+
+// Text returns the plain text of the message, without CQ codes or non-text segments.
+func (info MsgInfo) Text() string {
+	var raw string
+	if json.Unmarshal(info.Data.Message, &raw) == nil {
+		_, text, _ := ParseCQCode(raw)
+		return strings.Trim(text, " ")
+	}
+	var segments []Message
+	if json.Unmarshal(info.Data.Message, &segments) != nil {
+		return ""
+	}
+	var builder strings.Builder
+	for _, segment := range segments {
+		if text, ok := segment.Data["text"].(string); ok && segment.Type == "text" {
+			builder.WriteString(text)
+		}
+	}
+	return strings.Trim(builder.String(), " ")
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -21,67 +22,180 @@ type AITokenTransport struct {
 }
 
 func (t *AITokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Add("Authorization", "Bearer "+t.Token)
+	// endpoints of the fallback chain may carry their own key
+	if req.Header.Get("Authorization") == "" {
+		req.Header.Add("Authorization", "Bearer "+t.Token)
+	}
 	return t.Base.RoundTrip(req)
 }
 
 type ChatMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	Name    string `json:"name,omitempty"`
+	// UserId is the QQ id of the sender. It is kept in the record only and never sent to the API.
+	UserId string `json:"userId,omitempty"`
 }
 
 type AIRequest struct {
-	Model       string        `json:"model"`
-	Messages    []ChatMessage `json:"messages"`
-	Temperature float64       `json:"temperature"`
+	Model            string        `json:"model"`
+	Messages         []ChatMessage `json:"messages"`
+	Temperature      float64       `json:"temperature"`
+	TopP             float64       `json:"top_p,omitempty"`
+	PresencePenalty  float64       `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float64       `json:"frequency_penalty,omitempty"`
+	MaxTokens        int           `json:"max_tokens,omitempty"`
+	Stop             []string      `json:"stop,omitempty"`
+}
+
+type AIChoice struct {
+	Message      ChatMessage `json:"message"`
+	Index        int         `json:"index"`
+	FinishReason string      `json:"finish_reason"`
 }
 
 type AIResponse struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int    `json:"created"`
-	Model   string `json:"model"`
-	Choices []struct {
-		Message      ChatMessage `json:"message"`
-		Index        int         `json:"index"`
-		FinishReason string      `json:"finish_reason"`
-	} `json:"choices"`
-	Usage struct {
+	ID      string     `json:"id"`
+	Object  string     `json:"object"`
+	Created int        `json:"created"`
+	Model   string     `json:"model"`
+	Choices []AIChoice `json:"choices"`
+	Usage   struct {
 		PromptTokens     int `json:"prompt_tokens"`
 		CompletionTokens int `json:"completion_tokens"`
 		TotalTokens      int `json:"total_tokens"`
 	} `json:"usage"`
 }
 
+// AIError is returned by DoAIRequest when the API answers with a non-200 status.
+type AIError struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"message"`
+	Type       string `json:"type"`
+	Code       string `json:"code"`
+}
+
+func (e *AIError) Error() string {
+	return fmt.Sprintf("AI API error %d (%s): %s", e.StatusCode, e.Code, e.Message)
+}
+
 type Record struct {
-	Messages    []ChatMessage `json:"messages"`
-	TotalTokens int           `json:"totalTokens"`
-	LastRequest time.Time     `json:"lastRequest"`
-	Temperature float64       `json:"temperature"`
+	Messages         []ChatMessage `json:"messages"`
+	TotalTokens      int           `json:"totalTokens"`
+	LastRequest      time.Time     `json:"lastRequest"`
+	Temperature      float64       `json:"temperature"`
+	Model            string        `json:"model,omitempty"`
+	TopP             float64       `json:"topP,omitempty"`
+	PresencePenalty  float64       `json:"presencePenalty,omitempty"`
+	FrequencyPenalty float64       `json:"frequencyPenalty,omitempty"`
+	MaxTokens        int           `json:"maxTokens,omitempty"`
+	Stop             []string      `json:"stop,omitempty"`
+	Persona          string        `json:"persona,omitempty"`
+	SystemPrompt     string        `json:"systemPrompt,omitempty"`
+	// Mode is the chat mode ("private" or "group") the record was last used in, which selects its retention policy
+	Mode string `json:"mode,omitempty"`
+}
+
+// chatOptions changes a single AIChat call without touching the record.
+type chatOptions struct {
+	temperature *float64
+	skipCache   bool
 }
 
 func (data *SendMsgData) AIChat(mode string) error {
+	return data.aiChat(mode, chatOptions{})
+}
+
+func (data *SendMsgData) aiChat(mode string, options chatOptions) error {
 	var id string
 	if mode == "private" {
-		id = data.UserId
+		id = ChatKey(mode, data.UserId)
 	} else if mode == "group" {
-		id = data.GroupId
+		id = ChatKey(mode, data.GroupId)
 	}
 	record, err := RetrieveOrDefaultRecord(id)
 	if err != nil {
 		return fmt.Errorf("retrieve record error: %s", err)
 	}
-	req := AIRequest{
-		Model:       GlobalConfig.AI.Model,
-		Messages:    record.Messages,
-		Temperature: record.Temperature,
+	req := record.NewAIRequest()
+	if options.temperature != nil {
+		req.Temperature = *options.temperature
+	}
+	// the cache is keyed by the question without the retrieved knowledge, so it is checked before the retrieval
+	question := req
+	chain := ModelChain(req.Model)
+	used := chain[0]
+	var AIResp AIResponse
+	cached := false
+	if !options.skipCache {
+		AIResp, cached = question.LookupResponseCache(data.ChatGroupId())
+	}
+	if !cached && data.MessageType == "group" {
+		req.InjectKnowledge(data.GroupId)
 	}
 	logrus.Debug(req)
-	AIResp, err := req.GetAIResponseWithRetries(3)
-	if err != nil {
-		return err
+	Audit(AuditEvent{
+		Event:       "ai_request",
+		MessageType: data.MessageType,
+		UserId:      data.UserId,
+		GroupId:     data.ChatGroupId(),
+		Text:        req.Messages[len(req.Messages)-1].Content,
+		Model:       req.Model,
+	})
+	start := time.Now()
+	if !cached {
+		AIResp, used, err = req.GetAIResponseWithFallback(chain, 3)
+		if err != nil {
+			Audit(AuditEvent{
+				Event:       "ai_response",
+				MessageType: data.MessageType,
+				UserId:      data.UserId,
+				GroupId:     data.ChatGroupId(),
+				Model:       req.Model,
+				LatencyMs:   time.Since(start).Milliseconds(),
+				Error:       err.Error(),
+			})
+			return err
+		}
+		if used == chain[0] {
+			question.StoreResponseCache(data.ChatGroupId(), AIResp)
+		}
+		RecordUsage(data.UserId, data.ChatGroupId(), used.Model, AIResp)
+	}
+	Audit(AuditEvent{
+		Event:            "ai_response",
+		MessageType:      data.MessageType,
+		UserId:           data.UserId,
+		GroupId:          data.ChatGroupId(),
+		Text:             AIResp.Choices[0].Message.Content,
+		Model:            used.Model,
+		PromptTokens:     AIResp.Usage.PromptTokens,
+		CompletionTokens: AIResp.Usage.CompletionTokens,
+		LatencyMs:        time.Since(start).Milliseconds(),
+		Cached:           cached,
+	})
+	respText, ok := data.ModerateText(AIResp.Choices[0].Message.Content, "output")
+	if !ok {
+		data.Message = append(data.Message, Message{
+			Type: "text",
+			Data: map[string]interface{}{
+				"text": GlobalConfig.Moderation.BlockedReplyText,
+			},
+		})
+		err = UpdateRecord(id, func(record *Record) error {
+			record.LastRequest = time.Now()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return data.Send()
+	}
+	AIResp.Choices[0].Message.Content = respText
+	// the note is for display only: the record, and thus the context, export and retry, keep the answer itself
+	if used != chain[0] {
+		respText = strings.Trim(respText, "\n") + "\n[本回复由备用模型 " + used.Model + " 生成]"
 	}
-	respText := AIResp.Choices[0].Message.Content
 	data.Message = append(data.Message, Message{
 		Type: "text",
 		Data: map[string]interface{}{
@@ -92,13 +206,17 @@ func (data *SendMsgData) AIChat(mode string) error {
 	if err != nil {
 		return err
 	}
-	record.Messages = append(record.Messages, AIResp.Choices[0].Message)
-	record.TotalTokens += AIResp.Usage.TotalTokens
-	record.LastRequest = time.Now()
-	err = StoreRecord(id, record)
-	return err
+	return UpdateRecord(id, func(record *Record) error {
+		record.Messages = append(record.Messages, AIResp.Choices[0].Message)
+		record.TotalTokens += AIResp.Usage.TotalTokens
+		record.LastRequest = time.Now()
+		return nil
+	})
 }
 
+// groupModePrompt is appended to the system prompt of group sessions.
+const groupModePrompt = "AI在一个群聊内，作为一个群成员参与聊天。每条群成员消息以\"昵称: \"开头，回复时可以用昵称称呼对方。"
+
 func (data *SendMsgData) AddAIPrompts(mode string) error {
 	var userName string
 	var id string
@@ -111,35 +229,65 @@ func (data *SendMsgData) AddAIPrompts(mode string) error {
 		}
 		if memberInfo.Data.Card != "" {
 			userName = memberInfo.Data.Card
-		} else {
+		} else if memberInfo.Data.Nickname != "" {
 			userName = memberInfo.Data.Nickname
+		} else {
+			// the id is kept in the metadata of the message only
+			userName = "群成员"
 		}
-		id = data.GroupId
+		id = ChatKey(mode, data.GroupId)
 		maxTokens = GlobalConfig.AI.GroupChatMaxTokens
-		groupPrompt = "AI在一个群聊内，作为一个群成员参与聊天。"
+		groupPrompt = groupModePrompt
 	} else if mode == "private" {
-		userName = "user"
-		id = data.UserId
+		id = ChatKey(mode, data.UserId)
 		maxTokens = GlobalConfig.AI.PrivateChatMaxTokens
 	} else {
 		return errors.New("invalid mode")
 	}
-	record, err := RetrieveOrDefaultRecord(id)
+	quotaMessage, ok, err := data.CheckQuota()
 	if err != nil {
-		return fmt.Errorf("retrieve record error: %s", err)
+		return fmt.Errorf("check quota error: %s", err)
 	}
-	if len(record.Messages) == 1 && groupPrompt != "" {
-		record.Messages[0].Content += groupPrompt
+	if !ok {
+		if data.AddressedToBot {
+			data.Message = append(data.Message, Message{
+				Type: "text",
+				Data: map[string]interface{}{
+					"text": quotaMessage,
+				},
+			})
+			err = data.Send()
+			if err != nil {
+				return err
+			}
+		}
+		return ErrMessageRejected
 	}
-	if time.Now().Sub(record.LastRequest).Seconds() < GlobalConfig.AI.MinInterval {
-		data.Message = append(data.Message, Message{
-			Type: "text",
-			Data: map[string]interface{}{
-				"text": "别急，让我仔细想想[发送频率过快]",
-			},
-		})
-		err := data.Send()
-		return err
+	// only messages the bot replies to cost an AI call, silent context messages are never throttled
+	if data.AddressedToBot {
+		rateLimitMessage, ok, err := data.CheckRateLimit()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if rateLimitMessage != "" {
+				data.Message = append(data.Message, Message{
+					Type: "text",
+					Data: map[string]interface{}{
+						"text": rateLimitMessage,
+					},
+				})
+				err = data.Send()
+				if err != nil {
+					return err
+				}
+			}
+			return ErrMessageRejected
+		}
+	}
+	record, err := RetrieveOrDefaultRecord(id)
+	if err != nil {
+		return fmt.Errorf("retrieve record error: %s", err)
 	}
 	if record.TotalTokens > maxTokens {
 		data.Message = append(data.Message, Message{
@@ -152,25 +300,96 @@ func (data *SendMsgData) AddAIPrompts(mode string) error {
 		err = data.Send()
 		return err
 	}
-	record.Messages = append(record.Messages, ChatMessage{
-		Role:    userName,
-		Content: data.ReceivedMsg,
+	content, ok := data.ModerateText(data.ReceivedMsg, "input")
+	if !ok {
+		if mode == "private" {
+			data.Message = append(data.Message, Message{
+				Type: "text",
+				Data: map[string]interface{}{
+					"text": GlobalConfig.Moderation.RefuseMessage,
+				},
+			})
+			err = data.Send()
+			if err != nil {
+				return err
+			}
+		}
+		return ErrMessageRejected
+	}
+	message := ChatMessage{
+		Role:    "user",
+		Content: content,
+		UserId:  data.UserId,
+	}
+	if mode == "group" {
+		message.Name = SanitizeMessageName(userName)
+		message.Content = userName + ": " + content
+	}
+	// the record is updated in place, so that messages stored meanwhile by other instances are kept
+	return UpdateRecord(id, func(record *Record) error {
+		if record.SystemPrompt != "" {
+			// render the template again so that variables like {{.Now}} stay up to date
+			record.Messages[0].Content = data.RenderPrompt(record.SystemPrompt) + groupPrompt
+		} else if len(record.Messages) == 1 && groupPrompt != "" {
+			record.Messages[0].Content += groupPrompt
+		}
+		record.Mode = mode
+		record.Messages = append(record.Messages, message)
+		logrus.Debug(record)
+		return nil
 	})
-	err = StoreRecord(id, record)
-	logrus.Debug(record)
-	return err
 }
 
-func (reqBody *AIRequest) DoAIRequest() (AIResponse, error) {
+// ModelChain returns the primary endpoint for model followed by the configured fallback chain.
+func ModelChain(model string) []ModelEndpoint {
+	chain := []ModelEndpoint{{
+		Model:     model,
+		ChatAIUrl: GlobalConfig.AI.ChatAIUrl,
+		APIKey:    GlobalConfig.AI.APIKey,
+	}}
+	for _, endpoint := range GlobalConfig.AI.FallbackChain {
+		if endpoint.ChatAIUrl == "" {
+			endpoint.ChatAIUrl = GlobalConfig.AI.ChatAIUrl
+		}
+		if endpoint.APIKey == "" {
+			endpoint.APIKey = GlobalConfig.AI.APIKey
+		}
+		if endpoint == chain[0] {
+			continue
+		}
+		chain = append(chain, endpoint)
+	}
+	return chain
+}
+
+// shouldFallback reports whether err may be resolved by trying the next model of the chain:
+// rate limits, timeouts, server errors and exceeded context length.
+func shouldFallback(err error) bool {
+	var aiErr *AIError
+	if errors.As(err, &aiErr) {
+		return aiErr.StatusCode == http.StatusTooManyRequests ||
+			aiErr.StatusCode >= http.StatusInternalServerError ||
+			aiErr.Code == "context_length_exceeded" ||
+			strings.Contains(aiErr.Message, "maximum context length")
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+func (reqBody *AIRequest) DoAIRequest(endpoint ModelEndpoint) (AIResponse, error) {
 	body, err := json.Marshal(reqBody)
 	if err != nil {
 		return AIResponse{}, err
 	}
-	req, err := http.NewRequest("POST", GlobalConfig.AI.ChatAIUrl, bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", endpoint.ChatAIUrl, bytes.NewBuffer(body))
 	if err != nil {
 		return AIResponse{}, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+endpoint.APIKey)
 	resp, err := AIClient.Do(req)
 	if err != nil {
 		return AIResponse{}, err
@@ -180,6 +399,14 @@ func (reqBody *AIRequest) DoAIRequest() (AIResponse, error) {
 	if err != nil {
 		return AIResponse{}, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error AIError `json:"error"`
+		}
+		_ = json.Unmarshal(responseBody, &errResp)
+		errResp.Error.StatusCode = resp.StatusCode
+		return AIResponse{}, &errResp.Error
+	}
 	var AIResp AIResponse
 	err = json.Unmarshal(responseBody, &AIResp)
 	if err != nil {
@@ -188,11 +415,11 @@ func (reqBody *AIRequest) DoAIRequest() (AIResponse, error) {
 
 	return AIResp, nil
 }
-func (reqBody *AIRequest) GetAIResponseWithRetries(maxRetries int) (AIResponse, error) {
+func (reqBody *AIRequest) GetAIResponseWithRetries(endpoint ModelEndpoint, maxRetries int) (AIResponse, error) {
 	var result AIResponse
 	var err error
 	for i := 0; i < maxRetries; i++ {
-		result, err = reqBody.DoAIRequest()
+		result, err = reqBody.DoAIRequest(endpoint)
 		if err != nil {
 			return AIResponse{}, err
 		}
@@ -204,14 +431,24 @@ func (reqBody *AIRequest) GetAIResponseWithRetries(maxRetries int) (AIResponse,
 	return AIResponse{}, fmt.Errorf("no successful response after %d retries", maxRetries)
 }
 
-func DailyPromptsClear() {
-	t := time.NewTimer(SetTime(7, 0, 0))
-	defer t.Stop()
-	for {
-		select {
-		case <-t.C:
-			t.Reset(time.Hour * 24)
-			Connection.FlushAll(context.Background())
+// GetAIResponseWithFallback tries each endpoint of chain in turn and returns the endpoint that answered.
+func (reqBody *AIRequest) GetAIResponseWithFallback(chain []ModelEndpoint, maxRetries int) (AIResponse, ModelEndpoint, error) {
+	var err error
+	for i, endpoint := range chain {
+		req := *reqBody
+		req.Model = endpoint.Model
+		var result AIResponse
+		result, err = req.GetAIResponseWithRetries(endpoint, maxRetries)
+		if err == nil {
+			if i > 0 {
+				logrus.Warnf("[Fallback]model %s answered instead of %s", endpoint.Model, chain[0].Model)
+			}
+			return result, endpoint, nil
+		}
+		if !shouldFallback(err) {
+			return AIResponse{}, endpoint, err
 		}
+		logrus.Warnf("[Fallback]model %s failed: %s", endpoint.Model, err)
 	}
+	return AIResponse{}, ModelEndpoint{}, err
 }
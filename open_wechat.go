@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/silenceper/wechat/v2"
 	"github.com/silenceper/wechat/v2/cache"
@@ -41,14 +42,23 @@ func (h OpenWechatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 func handleMessage(msg message.MixMessage) *message.Reply {
 	data := SendMsgData{
-		MessageType: "private",
-		UserId:      string(msg.FromUserName),
-		GroupId:     "",
-		Message:     make([]Message, 0, 5),
-		AutoEscape:  false,
-		ReceivedMsg: msg.Content,
+		MessageType:    "private",
+		UserId:         string(msg.FromUserName),
+		GroupId:        "",
+		Message:        make([]Message, 0, 5),
+		AutoEscape:     false,
+		ReceivedMsg:    msg.Content,
+		AddressedToBot: true,
 	}
+	Audit(AuditEvent{Event: "inbound", MessageType: "private", UserId: data.UserId, Text: msg.Content})
+	defer LockSession(ChatKey("private", data.UserId))()
 	err := data.AddAIPrompts("private")
+	if errors.Is(err, ErrMessageRejected) && len(data.Message) > 0 {
+		return &message.Reply{
+			MsgType: message.MsgTypeText,
+			MsgData: message.NewText(fmt.Sprintf("%v", data.Message[0].Data["text"])),
+		}
+	}
 	if err != nil {
 		logrus.Errorf("add AI prompts error: %s", err)
 		return nil
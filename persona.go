@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AllPersonas merges the personas of config.yaml with those edited at runtime.
+func AllPersonas() map[string]Persona {
+	personas := make(map[string]Persona, len(GlobalConfig.AI.Personas))
+	for name, persona := range GlobalConfig.AI.Personas {
+		personas[name] = persona
+	}
+	runtimePersonas, err := RetrieveRuntimePersonas()
+	if err != nil {
+		logrus.Error("retrieve runtime personas fail: ", err)
+	}
+	for name, persona := range runtimePersonas {
+		personas[name] = persona
+	}
+	return personas
+}
+
+func LookupPersona(name string) (Persona, bool) {
+	persona, ok := AllPersonas()[name]
+	return persona, ok
+}
+
+// NewRecord creates an empty record initialized with the given persona, or with InitialPrompts
+// if the persona is empty or no longer exists.
+func NewRecord(personaName string) *Record {
+	record := Record{
+		Messages: []ChatMessage{
+			{
+				Role:    "system",
+				Content: GlobalConfig.AI.InitialPrompts,
+			},
+		},
+		TotalTokens:  0,
+		LastRequest:  time.UnixMicro(0),
+		Temperature:  GlobalConfig.AI.DefaultTemperature,
+		SystemPrompt: GlobalConfig.AI.InitialPrompts,
+	}
+	if personaName == "" {
+		return &record
+	}
+	persona, ok := LookupPersona(personaName)
+	if !ok {
+		logrus.Warn("persona not found, using initial prompts: ", personaName)
+		return &record
+	}
+	record.Persona = personaName
+	record.Messages[0].Content = persona.Prompt
+	record.SystemPrompt = persona.Prompt
+	record.Model = persona.Model
+	if persona.Temperature != nil {
+		record.Temperature = *persona.Temperature
+	}
+	return &record
+}
+
+// ExecutePersonaCommand handles "NerdBot persona list|show|use <name>|set <name> <prompt>|delete <name>".
+func (req QQMessage) ExecutePersonaCommand(args []string, idStr string, isAdmin bool) string {
+	subCommand, param, prompt := args[0], "", ""
+	if len(args) > 1 {
+		param = args[1]
+	}
+	if len(args) > 2 {
+		prompt = strings.Trim(args[2], " ")
+	}
+	switch subCommand {
+	case "list":
+		personas := AllPersonas()
+		if len(personas) == 0 {
+			return "[通知]当前没有可用的人格预设"
+		}
+		names := make([]string, 0, len(personas))
+		for name := range personas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "[通知]可用的人格预设:\n" + strings.Join(names, "\n")
+	case "show":
+		record, err := RetrieveOrDefaultRecord(idStr)
+		if err != nil {
+			logrus.Error(err)
+			return "[错误]获取人格失败:获取记录失败"
+		}
+		name := record.Persona
+		if name == "" {
+			name = "默认"
+		}
+		return fmt.Sprintf("[通知]当前人格: %s\n模型: %s\ntemperature: %g\nprompts: %s",
+			name, record.EffectiveModel(), record.Temperature, record.Messages[0].Content)
+	case "use":
+		if req.MessageType == "group" && !isAdmin {
+			return "[错误]\n对不起，您没有权限执行该命令"
+		}
+		if param == "default" {
+			param = ""
+		} else if _, ok := LookupPersona(param); !ok {
+			return "[错误]未找到人格预设: " + param
+		}
+		err := SetChatPersona(idStr, param)
+		if err != nil {
+			logrus.Error(err)
+			return "[错误]人格切换失败：存储设置失败"
+		}
+		DeleteRecord(idStr)
+		if param == "" {
+			return "[通知]已恢复默认人格，上下文已被清除。"
+		}
+		return "[通知]已切换为人格" + param + "，上下文已被清除。"
+	case "set", "delete":
+		if !isAdmin {
+			return "[错误]\n对不起，您没有权限执行该命令"
+		}
+		if param == "" {
+			return "[错误]用法: NerdBot persona " + subCommand + " [名称]"
+		}
+		if subCommand == "delete" {
+			return deleteRuntimePersona(param)
+		}
+		if prompt == "" {
+			return "[错误]用法: NerdBot persona set [名称] [prompts]"
+		}
+		// keep the model and temperature of the persona, whether they come from config.yaml or an earlier edit
+		persona, _ := LookupPersona(param)
+		persona.Prompt = prompt
+		err := StorePersona(param, persona)
+		if err != nil {
+			logrus.Error(err)
+			return "[错误]人格预设修改失败：存储设置失败"
+		}
+		return "[通知]人格预设" + param + "已更新，新建的会话将使用新的设定。"
+	}
+	return "[错误]未查询到相应指令，可用: persona list|show|use [名称]|set [名称] [prompts]|delete [名称]"
+}
+
+// deleteRuntimePersona removes the runtime edit of a persona, which restores the persona of config.yaml if
+// there is one.
+func deleteRuntimePersona(name string) string {
+	runtimePersonas, err := RetrieveRuntimePersonas()
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]人格预设删除失败：获取人格预设失败"
+	}
+	if _, ok := runtimePersonas[name]; !ok {
+		if _, ok = GlobalConfig.AI.Personas[name]; ok {
+			return "[错误]人格预设" + name + "没有运行时的修改，配置文件中的人格预设需在config.yaml中删除"
+		}
+		return "[错误]未找到人格预设: " + name
+	}
+	if err = DeletePersona(name); err != nil {
+		logrus.Error(err)
+		return "[错误]人格预设删除失败：存储设置失败"
+	}
+	if _, ok := GlobalConfig.AI.Personas[name]; ok {
+		return "[通知]已删除人格预设" + name + "的运行时修改，新建的会话将使用配置文件中的设定。"
+	}
+	return "[通知]人格预设" + name + "已删除。"
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PromptData holds the variables available to InitialPrompts and persona prompts.
+type PromptData struct {
+	Now          string
+	GroupName    string
+	UserNickname string
+	BotName      string
+	MemberCount  int32
+}
+
+// PromptData collects the template variables of the chat the message belongs to.
+func (data *SendMsgData) PromptData() PromptData {
+	promptData := PromptData{
+		Now:     time.Now().Format("2006-01-02 15:04 Monday"),
+		BotName: GlobalConfig.OneBot11.SelfNickname,
+	}
+	if GlobalConfig.ServeMode != "onebot" {
+		return promptData
+	}
+	if data.MessageType == "group" {
+		groupId, _ := strconv.ParseInt(data.GroupId, 10, 64)
+		groupInfo, err := GetGroupInfo(groupId)
+		if err != nil {
+			logrus.Error("get group info fail: ", err)
+		}
+		promptData.GroupName = groupInfo.Data.GroupName
+		promptData.MemberCount = groupInfo.Data.MemberCount
+		memberInfo, err := GetGroupMemberInfo(data.UserId, data.GroupId)
+		if err != nil {
+			logrus.Error("get group member info fail: ", err)
+		}
+		promptData.UserNickname = memberInfo.Data.Card
+		if promptData.UserNickname == "" {
+			promptData.UserNickname = memberInfo.Data.Nickname
+		}
+	} else {
+		strangerInfo, err := GetStrangerInfo(data.UserId)
+		if err != nil {
+			logrus.Error("get stranger info fail: ", err)
+		}
+		promptData.UserNickname = strangerInfo.Data.Nickname
+	}
+	return promptData
+}
+
+// RenderPrompt executes prompt as a text/template. The prompt is returned unchanged if it contains no
+// template action or fails to render.
+func (data *SendMsgData) RenderPrompt(prompt string) string {
+	if !strings.Contains(prompt, "{{") {
+		return prompt
+	}
+	tmpl, err := template.New("prompt").Parse(prompt)
+	if err != nil {
+		logrus.Error("parse prompt template fail: ", err)
+		return prompt
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data.PromptData())
+	if err != nil {
+		logrus.Error("render prompt template fail: ", err)
+		return prompt
+	}
+	return buf.String()
+}
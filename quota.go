@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type quotaScope struct {
+	scope string
+	id    string
+	name  string
+	limit QuotaLimit
+}
+
+// exceededPeriod returns the name and reset time of the first period in which stat exceeds limit.
+func exceededPeriod(limit QuotaLimit, today UsageStat, month UsageStat, now time.Time) (string, time.Time, bool) {
+	if (limit.DailyTokens > 0 && today.TotalTokens() >= limit.DailyTokens) ||
+		(limit.DailyCost > 0 && today.Cost >= limit.DailyCost) {
+		return "今日", time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()), true
+	}
+	if (limit.MonthlyTokens > 0 && month.TotalTokens() >= limit.MonthlyTokens) ||
+		(limit.MonthlyCost > 0 && month.Cost >= limit.MonthlyCost) {
+		return "本月", time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location()), true
+	}
+	return "", time.Time{}, false
+}
+
+// CheckQuota checks the quotas of the user, the group and the whole bot. If one is exhausted,
+// it returns the message telling the user when the quota resets.
+func (data *SendMsgData) CheckQuota() (string, bool, error) {
+	userId, _ := strconv.ParseInt(data.UserId, 10, 64)
+	if IsAdmin(userId) {
+		return "", true, nil
+	}
+	scopes := []quotaScope{
+		{scope: "user", id: data.UserId, name: "您", limit: GlobalConfig.Quota.User},
+		{scope: "global", name: "机器人", limit: GlobalConfig.Quota.Global},
+	}
+	if groupId := data.ChatGroupId(); groupId != "" {
+		limit := GlobalConfig.Quota.Group
+		settings, err := GetGroupSettings(groupId)
+		if err != nil {
+			return "", false, err
+		}
+		if settings.Quota != nil {
+			limit = *settings.Quota
+		}
+		scopes = append(scopes, quotaScope{scope: "group", id: groupId, name: "本群", limit: limit})
+	}
+	now := time.Now()
+	for _, s := range scopes {
+		if s.limit == (QuotaLimit{}) {
+			continue
+		}
+		today, err := GetUsage(DayPeriod(now), s.scope, s.id)
+		if err != nil {
+			return "", false, err
+		}
+		month, err := GetUsage(MonthPeriod(now), s.scope, s.id)
+		if err != nil {
+			return "", false, err
+		}
+		if period, resetTime, exceeded := exceededPeriod(s.limit, today, month, now); exceeded {
+			return fmt.Sprintf("[通知]%s%s的AI额度已用尽，将于%s重置", s.name, period, resetTime.Format("2006-01-02 15:04")), false, nil
+		}
+	}
+	return "", true, nil
+}
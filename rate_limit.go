@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// CheckRateLimit takes one AI call from the token buckets of the user, the group and the whole bot.
+// If one of them is empty, the call is rejected and, with the warn action, the message to send is
+// returned once per window; otherwise it is empty.
+func (data *SendMsgData) CheckRateLimit() (string, bool, error) {
+	userId, _ := strconv.ParseInt(data.UserId, 10, 64)
+	if IsAdmin(userId) {
+		return "", true, nil
+	}
+	var keys []string
+	var limits []BucketLimit
+	addBucket := func(scope string, id string, limit BucketLimit) {
+		if limit.Rate <= 0 || limit.Burst <= 0 {
+			return
+		}
+		keys = append(keys, rateLimitKey(scope, id))
+		limits = append(limits, limit)
+	}
+	addBucket("user", data.UserId, GlobalConfig.RateLimit.User)
+	if groupId := data.ChatGroupId(); groupId != "" {
+		addBucket("group", groupId, GlobalConfig.RateLimit.Group)
+	}
+	addBucket("global", "", GlobalConfig.RateLimit.Global)
+	if len(keys) == 0 {
+		return "", true, nil
+	}
+	rejected, retryAfter, err := TakeRateLimitTokens(keys, limits)
+	if err != nil {
+		return "", false, fmt.Errorf("take rate limit tokens error: %s", err)
+	}
+	if rejected < 0 {
+		return "", true, nil
+	}
+	if GlobalConfig.RateLimit.RejectAction != "warn" {
+		return "", false, nil
+	}
+	first, err := MarkRateLimitWarned(keys[rejected], data.UserId, retryAfter)
+	if err != nil || !first {
+		return "", false, err
+	}
+	return GlobalConfig.RateLimit.RejectMessage, false, nil
+}
@@ -2,70 +2,234 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"github.com/go-redis/redis/v8"
-	"github.com/sirupsen/logrus"
 	"time"
 )
 
-var Connection *redis.Client
+// RedisStorage keeps the state in Redis, so that several instances of the bot can share it.
+type RedisStorage struct {
+	client  *redis.Client
+	cmdable redis.Cmdable
+}
 
-func InitRedis() {
-	Connection = redis.NewClient(&redis.Options{
-		Addr:     GlobalConfig.Redis.Address,
-		Password: GlobalConfig.Redis.Password,
-		DB:       GlobalConfig.Redis.Database,
+func NewRedisStorage(config RedisConfig) (*RedisStorage, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     config.Address,
+		Password: config.Password,
+		DB:       config.Database,
 	})
-	pong, err := Connection.Ping(context.Background()).Result()
+	err := client.Ping(context.Background()).Err()
 	if err != nil {
-		panic(err)
+		client.Close()
+		return nil, err
+	}
+	return &RedisStorage{client: client, cmdable: client}, nil
+}
+
+func (s *RedisStorage) Get(key string) (string, error) {
+	value, err := s.cmdable.Get(context.Background(), key).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return value, err
+}
+
+func (s *RedisStorage) Set(key string, value string, ttl time.Duration) error {
+	return s.cmdable.Set(context.Background(), key, value, ttl).Err()
+}
+
+func (s *RedisStorage) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	return s.cmdable.SetNX(context.Background(), key, value, ttl).Result()
+}
+
+func (s *RedisStorage) Del(keys ...string) error {
+	return s.cmdable.Del(context.Background(), keys...).Err()
+}
+
+func (s *RedisStorage) Exists(key string) (bool, error) {
+	count, err := s.cmdable.Exists(context.Background(), key).Result()
+	return count > 0, err
+}
+
+func (s *RedisStorage) Rename(key string, newKey string) error {
+	return s.cmdable.Rename(context.Background(), key, newKey).Err()
+}
+
+func (s *RedisStorage) RenameNX(key string, newKey string) (bool, error) {
+	return s.cmdable.RenameNX(context.Background(), key, newKey).Result()
+}
+
+func (s *RedisStorage) Expire(key string, ttl time.Duration) error {
+	return s.cmdable.Expire(context.Background(), key, ttl).Err()
+}
+
+func (s *RedisStorage) Scan(pattern string) ([]string, error) {
+	ctx := context.Background()
+	var keys []string
+	iter := s.cmdable.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
 	}
-	logrus.Info("initiate GoRedis Client success: ", pong)
+	return keys, iter.Err()
+}
+
+func (s *RedisStorage) HSet(key string, values map[string]string) error {
+	return s.cmdable.HSet(context.Background(), key, values).Err()
+}
+
+func (s *RedisStorage) HGetAll(key string) (map[string]string, error) {
+	return s.cmdable.HGetAll(context.Background(), key).Result()
 }
 
-func StoreRecord(key string, record *Record) error {
-	// Convert the Record struct to JSON
-	recordJSON, err := json.Marshal(record)
+func (s *RedisStorage) HDel(key string, fields ...string) error {
+	return s.cmdable.HDel(context.Background(), key, fields...).Err()
+}
+
+func (s *RedisStorage) HLen(key string) (int64, error) {
+	return s.cmdable.HLen(context.Background(), key).Result()
+}
+
+func (s *RedisStorage) HExists(key string, field string) (bool, error) {
+	return s.cmdable.HExists(context.Background(), key, field).Result()
+}
+
+func (s *RedisStorage) HIncrBy(key string, field string, incr int64) error {
+	return s.cmdable.HIncrBy(context.Background(), key, field, incr).Err()
+}
+
+func (s *RedisStorage) HIncrByFloat(key string, field string, incr float64) error {
+	return s.cmdable.HIncrByFloat(context.Background(), key, field, incr).Err()
+}
+
+func (s *RedisStorage) SAdd(key string, members ...string) error {
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return s.cmdable.SAdd(context.Background(), key, values...).Err()
+}
+
+func (s *RedisStorage) SRem(key string, members ...string) error {
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return s.cmdable.SRem(context.Background(), key, values...).Err()
+}
+
+func (s *RedisStorage) SIsMember(key string, member string) (bool, error) {
+	return s.cmdable.SIsMember(context.Background(), key, member).Result()
+}
+
+func (s *RedisStorage) SMembers(key string) ([]string, error) {
+	return s.cmdable.SMembers(context.Background(), key).Result()
+}
+
+func (s *RedisStorage) ZIncrBy(key string, member string, incr float64) error {
+	return s.cmdable.ZIncrBy(context.Background(), key, incr, member).Err()
+}
+
+func (s *RedisStorage) ZRevRange(key string, n int64) ([]ScoredMember, error) {
+	values, err := s.cmdable.ZRevRangeWithScores(context.Background(), key, 0, n-1).Result()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	members := make([]ScoredMember, len(values))
+	for i, z := range values {
+		member, _ := z.Member.(string)
+		members[i] = ScoredMember{Member: member, Score: z.Score}
 	}
+	return members, nil
+}
 
-	// Store the JSON in Redis
-	err = Connection.Set(context.Background(), key, recordJSON, 0).Err()
+func (s *RedisStorage) Pipelined(fn func(pipe Storage) error) error {
+	_, err := s.cmdable.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		return fn(&RedisStorage{client: s.client, cmdable: pipe})
+	})
+	if err == redis.TxFailedErr {
+		return ErrTxConflict
+	}
+	return err
+}
+
+func (s *RedisStorage) Watch(fn func(tx Storage) error, keys ...string) error {
+	err := s.client.Watch(context.Background(), func(tx *redis.Tx) error {
+		return fn(&RedisStorage{client: s.client, cmdable: tx})
+	}, keys...)
+	if err == redis.TxFailedErr {
+		return ErrTxConflict
+	}
+	return err
+}
+
+func (s *RedisStorage) Publish(channel string, message string) error {
+	return s.client.Publish(context.Background(), channel, message).Err()
+}
+
+func (s *RedisStorage) Subscribe(channel string, handler func(message string)) error {
+	ctx := context.Background()
+	pubSub := s.client.Subscribe(ctx, channel)
+	// wait for the subscription to be confirmed, so that no message published afterwards is missed
+	_, err := pubSub.Receive(ctx)
 	if err != nil {
+		pubSub.Close()
 		return err
 	}
+	go func() {
+		for msg := range pubSub.Channel() {
+			handler(msg.Payload)
+		}
+	}()
 	return nil
 }
 
-func RetrieveOrDefaultRecord(key string) (*Record, error) {
-	// Get the stored JSON from Redis
-	recordJSON, err := Connection.Get(context.Background(), key).Bytes()
-	if err == redis.Nil {
-		ori := Record{
-			Messages: []ChatMessage{
-				{
-					Role:    "system",
-					Content: GlobalConfig.AI.InitialPrompts,
-				},
-			},
-			TotalTokens: 0,
-			LastRequest: time.UnixMicro(0),
-			Temperature: GlobalConfig.AI.DefaultTemperature,
-		}
-		return &ori, nil
-	} else if err != nil {
-		return nil, err
+// takeTokensScript refills every bucket in KEYS by the time passed since its last update and takes one
+// token from each of them, but only if all of them have one left. ARGV holds the current time in
+// milliseconds followed by the rate and burst of each bucket. It returns the 1-based index of the first
+// empty bucket and the milliseconds until it has a token again, or {0, 0} if the tokens were taken.
+var takeTokensScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tokens = {}
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2])
+	local burst = tonumber(ARGV[i * 2 + 1])
+	local bucket = redis.call('HMGET', key, 'tokens', 'ts')
+	local last = tonumber(bucket[1]) or burst
+	local ts = tonumber(bucket[2]) or now
+	last = math.min(burst, last + math.max(0, now - ts) / 1000 * rate)
+	if last < 1 then
+		return {i, math.ceil((1 - last) / rate * 1000)}
+	end
+	tokens[i] = last
+end
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2])
+	local burst = tonumber(ARGV[i * 2 + 1])
+	redis.call('HSET', key, 'tokens', tokens[i] - 1, 'ts', now)
+	redis.call('PEXPIRE', key, math.ceil(burst / rate * 1000))
+end
+return {0, 0}
+`)
+
+func (s *RedisStorage) TakeTokens(keys []string, limits []BucketLimit, now time.Time) (int, time.Duration, error) {
+	args := []interface{}{now.UnixMilli()}
+	for _, limit := range limits {
+		args = append(args, limit.Rate, limit.Burst)
 	}
-	// Convert the JSON to a Record struct
-	var record Record
-	err = json.Unmarshal(recordJSON, &record)
+	result, err := takeTokensScript.Run(context.Background(), s.cmdable, keys, args...).Result()
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
-
-	return &record, err
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, 0, errors.New("unexpected rate limit script result")
+	}
+	index, _ := values[0].(int64)
+	retryAfter, _ := values[1].(int64)
+	return int(index) - 1, time.Duration(retryAfter) * time.Millisecond, nil
 }
-func DeleteRecord(key string) {
-	Connection.Del(context.Background(), key)
+
+func (s *RedisStorage) Close() error {
+	return s.client.Close()
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -54,6 +55,7 @@ type ReceivedCQTypes struct {
 	hasJson  bool
 	hasFace  bool
 	hasReply bool
+	replyId  string
 }
 
 func reply(ctx *gin.Context) {
@@ -68,6 +70,19 @@ func reply(ctx *gin.Context) {
 		HeartbeatContinue()
 		return
 	}
+	// blocked users and groups are dropped before they take a slot of the event queue
+	if req.PostType == "message" && !req.Permitted() {
+		ctx.Status(http.StatusNoContent)
+		return
+	}
+	// acknowledge at once, so that the OneBot implementation neither times out nor retries
+	Events.Submit(req)
+	ctx.Status(http.StatusNoContent)
+}
+
+// handleEvent processes a received event on a worker of the event queue.
+func handleEvent(req QQMessage) {
+	var err error
 	logrus.Info("Received message: ", req.Message)
 	sender := SendMsgData{
 		MessageType: req.MessageType,
@@ -77,8 +92,20 @@ func reply(ctx *gin.Context) {
 		AutoEscape:  false,
 		ReceivedMsg: req.RawMessage,
 	}
-	if strings.HasPrefix(req.RawMessage, "NerdBot ") {
-		msg := req.ExecuteCommand()
+	Audit(AuditEvent{
+		Event:       "inbound",
+		MessageType: req.MessageType,
+		UserId:      sender.UserId,
+		GroupId:     sender.ChatGroupId(),
+		MessageId:   req.MessageId,
+		Text:        req.RawMessage,
+	})
+	if command, ok := ParseCommand(req.RawMessage); ok {
+		msg := req.ExecuteCommand(command)
+		if msg.Data["text"] == "" {
+			// the command has replied by itself
+			return
+		}
 		sender.Message = append(sender.Message, msg)
 		err = sender.Send()
 		if err != nil {
@@ -86,25 +113,41 @@ func reply(ctx *gin.Context) {
 		}
 		return
 	}
+	if req.MessageType == "group" && !GroupSettingsOrDefault(req.GroupId).Enabled() {
+		// only admin commands reach a disabled group or one not on the allow list
+		return
+	}
 	cqMessage, remainText, types := ParseCQCode(req.RawMessage)
 	req.CqTypes = types
 	remainText = strings.Trim(remainText, " ")
-	enableGroupChat, ok := GlobalConfig.AI.EnableGroupChat[req.GroupId]
+	// a reply to one of the bot's own messages, the bot's name or a trigger address the bot just like an @
+	addressed := req.CqTypes.atSelf || (req.MessageType == "group" && req.Triggered(remainText))
+	if req.CqTypes.hasReply {
+		quoted, err := GetMsg(req.CqTypes.replyId)
+		if err != nil {
+			logrus.Error("get quoted message fail: ", err)
+		} else {
+			if quoted.Data.Sender.UserId == GlobalConfig.OneBot11.SelfId {
+				addressed = true
+			}
+			sender.ReceivedMsg = QuoteContext(quoted) + sender.ReceivedMsg
+		}
+	}
 	var chatMode string
 	enableAIReply := true
 	if req.MessageType == "group" {
-		if ok && enableGroupChat {
+		if GroupSettingsOrDefault(req.GroupId).GroupMode {
 			// if the bot is in group mode
 			chatMode = "group"
 			// do not reply if the bot is not mentioned
-			if !req.CqTypes.atSelf {
+			if !addressed {
 				enableAIReply = false
 			}
-		} else if req.CqTypes.atSelf {
+		} else if addressed {
 			chatMode = "private"
 		}
 	} else if req.MessageType == "private" {
-		if cqMessage == nil {
+		if cqMessage == nil || req.CqTypes.hasReply {
 			chatMode = "private"
 		}
 	}
@@ -117,25 +160,34 @@ func reply(ctx *gin.Context) {
 		})
 	}
 	if chatMode != "" {
+		sessionId := sender.UserId
+		if chatMode == "group" {
+			sessionId = sender.GroupId
+		}
+		// messages of the same session are processed one after another in arrival order
+		defer LockSession(ChatKey(chatMode, sessionId))()
+		sender.AddressedToBot = enableAIReply
 		err = sender.AddAIPrompts(chatMode)
+		if errors.Is(err, ErrMessageRejected) {
+			return
+		}
 		if err != nil {
 			logrus.Error("Add AI "+chatMode+" prompts error: ", err)
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		if enableAIReply {
 			err = sender.AIChat(chatMode)
 			if err != nil {
 				logrus.Error("AI chat in "+chatMode+" error: ", err)
-				ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
 		}
 	}
 }
 
-func (req QQMessage) ExecuteCommand() Message {
-	var isAdmin = false
+// ExecuteCommand executes a command parsed by ParseCommand, i.e. without prefix and with aliases resolved,
+// looking it up in the command registry.
+func (req QQMessage) ExecuteCommand(command string) Message {
 	var msg = Message{
 		Type: "text",
 		Data: map[string]interface{}{
@@ -143,89 +195,56 @@ func (req QQMessage) ExecuteCommand() Message {
 		},
 	}
 
-	enableGroupChat, ok := GlobalConfig.AI.EnableGroupChat[req.GroupId]
+	var groupMode bool
+	if req.MessageType == "group" {
+		groupMode = GroupSettingsOrDefault(req.GroupId).GroupMode
+	}
 	var id int64
-	if req.MessageType == "group" && enableGroupChat {
+	mode := "private"
+	if groupMode {
 		id = req.GroupId
+		mode = "group"
 	} else {
 		id = req.UserId
 	}
-	idStr := strconv.FormatInt(id, 10)
+	idStr := ChatKey(mode, strconv.FormatInt(id, 10))
+	defer LockSession(idStr)()
 
-	remainText := strings.Replace(req.RawMessage, "NerdBot ", "", -1)
-	remainText = strings.Trim(remainText, " ")
-	for _, id := range GlobalConfig.Server.AdminIds {
-		if req.UserId == id {
-			isAdmin = true
-		}
+	isAdmin := IsAdmin(req.UserId)
+	c, args := FindCommand(command)
+	if c == nil {
+		msg.Data["text"] = unknownCommandText(command, req, isAdmin)
+		logrus.Error("invalid command: ", req.RawMessage)
+		return msg
 	}
-
-	if remainText == "clear" {
-		DeleteRecord(idStr)
-		msg.Data["text"] = fmt.Sprintf("[通知]ID: %d 的上下文已被清除。", id)
+	if text, ok := c.Check(req, isAdmin); !ok {
+		msg.Data["text"] = text
 		return msg
 	}
-
-	//all the command below need Auth
-	if !isAdmin {
-		msg.Data["text"] = "[错误]\n对不起，您没有权限执行该命令"
+	parsedArgs, err := ParseCommandArgs(c.Args, args)
+	if err != nil {
+		msg.Data["text"] = fmt.Sprintf("[错误]%s\n用法: %s", err, c.Usage())
 		return msg
 	}
-	if req.MessageType == "private" {
+	msg.Data["text"] = c.Run(&CommandContext{Req: req, Args: parsedArgs, Mode: mode, Id: id, Key: idStr, IsAdmin: isAdmin})
+	return msg
+}
 
-	} else if req.MessageType == "group" {
-		if remainText == "group mode" {
-			if !ok || !enableGroupChat {
-				GlobalConfig.AI.EnableGroupChat[req.GroupId] = true
-				DeleteRecord(idStr)
-				msg.Data["text"] = "[通知]\n群" + strconv.FormatInt(req.GroupId, 10) + "的群聊模式已开启，之后所有群聊文字信息" +
-					"将以同一session供机器人进行分析。如需机器人进行回复，请在输入信息中@戴便机器人。\n注意: 此功能为实验性功能。另，群聊模式可能使用大量token，" +
-					"请注意您的token使用量。"
-			} else {
-				msg.Data["text"] = "[错误]\n群" + strconv.FormatInt(req.GroupId, 10) + "的群聊模式已开启，无须重复操作。"
-			}
-			return msg
-		} else if remainText == "private mode" {
-			if ok && enableGroupChat {
-				GlobalConfig.AI.EnableGroupChat[req.GroupId] = false
-				DeleteRecord(idStr)
-				msg.Data["text"] = "[通知]\n群聊模式已关闭，机器人将恢复 1 vs 1 对话"
-			} else {
-				msg.Data["text"] = "[错误]群聊模式已经为关闭状态，无须操作"
-			}
-			return msg
-		}
-	}
+// quoteMaxLength is the number of characters of a quoted message included as context.
+const quoteMaxLength = 200
 
-	if strings.HasPrefix(remainText, "set temperature") {
-		str := strings.Replace(remainText, "set temperature", "", -1)
-		str = strings.Trim(str, " ")
-		temp, err := strconv.ParseFloat(str, 10)
-		if err != nil {
-			logrus.Error(err)
-		}
-		if temp < 0 || temp > 1 {
-			msg.Data["text"] = "[错误]无效的temperature设置，值应该为0~1之间的小数"
-			logrus.Error("invalid temperature setting: ", temp)
-			return msg
-		}
-		record, err := RetrieveOrDefaultRecord(idStr)
-		if err != nil {
-			msg.Data["text"] = fmt.Sprintf("[错误]temperature参数设置失败:获取记录失败")
-			logrus.Error(err)
-		} else {
-			record.Temperature = temp
-			err = StoreRecord(idStr, record)
-			if err != nil {
-				msg.Data["text"] = fmt.Sprintf("[错误]temperature参数设置失败：存储记录失败")
-				logrus.Error(err)
-			} else {
-				msg.Data["text"] = fmt.Sprintf("[通知]新的temperature参数已生效: %f", temp)
-			}
-		}
-		return msg
+// QuoteContext describes the quoted message for the AI, e.g. "[回复 X: ...]".
+func QuoteContext(quoted MsgInfo) string {
+	text := []rune(quoted.Text())
+	if len(text) == 0 {
+		return ""
 	}
-	msg.Data["text"] = "[错误]未查询到相应指令"
-	logrus.Error("invalid command: ", req.RawMessage)
-	return msg
+	if len(text) > quoteMaxLength {
+		text = append(text[:quoteMaxLength], []rune("...")...)
+	}
+	name := quoted.Data.Sender.Nickname
+	if quoted.Data.Sender.UserId == GlobalConfig.OneBot11.SelfId {
+		name = "你"
+	}
+	return "[回复 " + name + ": " + string(text) + "]\n"
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// NormalizePrompt folds case, whitespace and trailing punctuation so that trivially different
+// spellings of the same question share a cache entry.
+func NormalizePrompt(prompt string) string {
+	prompt = strings.ToLower(strings.Join(strings.Fields(prompt), " "))
+	return strings.TrimRightFunc(prompt, func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSpace(r) || r == '~'
+	})
+}
+
+var (
+	cqCodePattern       = regexp.MustCompile(`\[CQ:[^\]]*\]`)
+	quoteContextPattern = regexp.MustCompile(`(?s)^\[回复 .*?\]\n`)
+)
+
+// splitPrompt splits a user message into the context the question depends on, i.e. the quoted message, and
+// the text of the user without the speaker prefix of group mode and without CQ codes.
+func splitPrompt(message ChatMessage) (string, string) {
+	content := message.Content
+	if message.Name != "" {
+		// "昵称: text" in group mode
+		if i := strings.Index(content, ": "); i >= 0 {
+			content = content[i+len(": "):]
+		}
+	}
+	quote := quoteContextPattern.FindString(content)
+	return quote, cqCodePattern.ReplaceAllString(content[len(quote):], "")
+}
+
+type responseCacheKey struct {
+	answerKey string
+	indexKey  string
+	prompt    string
+	model     string
+}
+
+// newResponseCacheKey keys the cache by the normalized question of the last message and by everything the
+// answer depends on besides the history: the model, the rendered system messages, the quoted message and the
+// group the question was asked in, so that answers grounded in a group's knowledge base stay in the group.
+func newResponseCacheKey(req *AIRequest, groupId string) (responseCacheKey, bool) {
+	if len(req.Messages) == 0 {
+		return responseCacheKey{}, false
+	}
+	quote, text := splitPrompt(req.Messages[len(req.Messages)-1])
+	prompt := NormalizePrompt(text)
+	if prompt == "" {
+		return responseCacheKey{}, false
+	}
+	scope := sha256.New()
+	for _, part := range []string{req.Model, groupId, quote} {
+		scope.Write([]byte(part + "\x00"))
+	}
+	for _, message := range req.Messages {
+		if message.Role == "system" {
+			scope.Write([]byte(message.Content + "\x00"))
+		}
+	}
+	scopeHash := scope.Sum(nil)
+	hash := sha256.Sum256(append(scopeHash, prompt...))
+	return responseCacheKey{
+		answerKey: Key("cache", hex.EncodeToString(hash[:])),
+		indexKey:  Key("cache", "embeddings", hex.EncodeToString(scopeHash[:16])),
+		prompt:    prompt,
+		model:     req.Model,
+	}, true
+}
+
+// LookupResponseCache returns a cached answer to the request asked in a group ("" for private chats), first by
+// exact match and then, if enabled, by embedding similarity.
+func (req *AIRequest) LookupResponseCache(groupId string) (AIResponse, bool) {
+	if !GlobalConfig.Cache.Enable {
+		return AIResponse{}, false
+	}
+	key, ok := newResponseCacheKey(req, groupId)
+	if !ok {
+		return AIResponse{}, false
+	}
+	answer, err := GetCachedResponse(key.answerKey)
+	if err != nil {
+		logrus.Error("get cached response fail: ", err)
+		return AIResponse{}, false
+	}
+	if answer == "" && GlobalConfig.Cache.EnableEmbedding {
+		answer = lookupSimilarResponse(key)
+	}
+	if answer == "" {
+		return AIResponse{}, false
+	}
+	logrus.Info("[Cache]hit: ", key.prompt)
+	resp := AIResponse{
+		Model: key.model,
+		Choices: []AIChoice{{
+			Message:      ChatMessage{Role: "assistant", Content: answer},
+			FinishReason: "stop",
+		}},
+	}
+	return resp, true
+}
+
+func lookupSimilarResponse(key responseCacheKey) string {
+	embedding, err := GetEmbedding(key.prompt)
+	if err != nil {
+		logrus.Error("get prompt embedding fail: ", err)
+		return ""
+	}
+	embeddings, err := RetrieveCacheEmbeddings(key.indexKey)
+	if err != nil {
+		logrus.Error("retrieve cache embeddings fail: ", err)
+		return ""
+	}
+	bestKey, bestSimilarity := "", GlobalConfig.Cache.SimilarityThreshold
+	for answerKey, cached := range embeddings {
+		similarity := CosineSimilarity(embedding, cached)
+		if similarity >= bestSimilarity {
+			bestKey, bestSimilarity = answerKey, similarity
+		}
+	}
+	if bestKey == "" {
+		return ""
+	}
+	answer, err := GetCachedResponse(bestKey)
+	if err != nil {
+		logrus.Error("get cached response fail: ", err)
+		return ""
+	}
+	if answer == "" {
+		// the answer has expired, drop its embedding as well
+		_ = DeleteCacheEmbedding(key.indexKey, bestKey)
+	}
+	return answer
+}
+
+// StoreResponseCache caches a complete answer to the request.
+func (req *AIRequest) StoreResponseCache(groupId string, resp AIResponse) {
+	if !GlobalConfig.Cache.Enable || len(resp.Choices) == 0 || resp.Choices[0].FinishReason != "stop" {
+		return
+	}
+	key, ok := newResponseCacheKey(req, groupId)
+	if !ok {
+		return
+	}
+	ttl := time.Duration(GlobalConfig.Cache.TTL) * time.Second
+	err := StoreCachedResponse(key.answerKey, resp.Choices[0].Message.Content, ttl)
+	if err != nil {
+		logrus.Error("store cached response fail: ", err)
+		return
+	}
+	if !GlobalConfig.Cache.EnableEmbedding {
+		return
+	}
+	embedding, err := GetEmbedding(key.prompt)
+	if err != nil {
+		logrus.Error("get prompt embedding fail: ", err)
+		return
+	}
+	err = StoreCacheEmbedding(key.indexKey, key.answerKey, embedding, GlobalConfig.Cache.MaxEntries, ttl)
+	if err != nil {
+		logrus.Error("store cache embedding fail: ", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestNormalizePrompt(t *testing.T) {
+	tests := []struct {
+		prompt string
+		want   string
+	}{
+		{"Hello World", "hello world"},
+		{"  什么是  Go？ ", "什么是 go"},
+		{"what is go?!~", "what is go"},
+		{"a\n\tb", "a b"},
+		{"？？", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizePrompt(tt.prompt); got != tt.want {
+			t.Errorf("NormalizePrompt(%q) = %q, want %q", tt.prompt, got, tt.want)
+		}
+	}
+}
+
+func TestSplitPrompt(t *testing.T) {
+	tests := []struct {
+		message ChatMessage
+		quote   string
+		text    string
+	}{
+		{ChatMessage{Role: "user", Content: "你好"}, "", "你好"},
+		{ChatMessage{Role: "user", Content: "小明: 你好", Name: "u_1"}, "", "你好"},
+		{ChatMessage{Role: "user", Content: "[CQ:at,qq=10001] 你好"}, "", " 你好"},
+		{
+			ChatMessage{Role: "user", Content: "小明: [回复 小红: 今天\n下雨]\n为什么", Name: "u_1"},
+			"[回复 小红: 今天\n下雨]\n", "为什么",
+		},
+	}
+	for _, tt := range tests {
+		quote, text := splitPrompt(tt.message)
+		if quote != tt.quote || text != tt.text {
+			t.Errorf("splitPrompt(%q) = %q, %q, want %q, %q", tt.message.Content, quote, text, tt.quote, tt.text)
+		}
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	setTestConfig(t, &Config{ServeMode: "onebot"})
+	request := func(system string, content string, name string) *AIRequest {
+		return &AIRequest{Model: "gpt", Messages: []ChatMessage{
+			{Role: "system", Content: system},
+			{Role: "user", Content: content, Name: name},
+		}}
+	}
+	key := func(req *AIRequest, groupId string) string {
+		k, ok := newResponseCacheKey(req, groupId)
+		if !ok {
+			t.Fatalf("newResponseCacheKey(%q) is not cacheable", req.Messages[len(req.Messages)-1].Content)
+		}
+		return k.answerKey
+	}
+	base := key(request("sys", "小明: 什么是Go？", "u_1"), "1")
+	tests := []struct {
+		name  string
+		req   *AIRequest
+		group string
+		same  bool
+	}{
+		{"other speaker", request("sys", "小红: 什么是go", "u_2"), "1", true},
+		{"other group", request("sys", "小明: 什么是Go？", "u_1"), "2", false},
+		{"private chat", request("sys", "什么是Go？", ""), "", false},
+		{"other system prompt", request("sys2", "小明: 什么是Go？", "u_1"), "1", false},
+		{"quoted message", request("sys", "小明: [回复 小红: Go]\n什么是Go？", "u_1"), "1", false},
+	}
+	for _, tt := range tests {
+		if got := key(tt.req, tt.group) == base; got != tt.same {
+			t.Errorf("%s: same key = %v, want %v", tt.name, got, tt.same)
+		}
+	}
+	if _, ok := newResponseCacheKey(request("sys", "[CQ:image,file=a.jpg]", ""), ""); ok {
+		t.Error("a message without text is cacheable")
+	}
+}
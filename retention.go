@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+func RetentionPolicyOf(mode string) RetentionPolicy {
+	if mode == "group" {
+		return GlobalConfig.Retention.Group
+	}
+	return GlobalConfig.Retention.Private
+}
+
+// IdleExpiration returns the expiration of a record after its last update, 0 meaning no expiration.
+func (policy RetentionPolicy) IdleExpiration() time.Duration {
+	if policy.IdleTTL <= 0 {
+		return 0
+	}
+	return time.Duration(policy.IdleTTL) * time.Second
+}
+
+func parseResetTime(resetTime string) (int, int, error) {
+	var hour, min int
+	_, err := fmt.Sscanf(resetTime, "%d:%d", &hour, &min)
+	if err != nil || hour < 0 || hour > 23 || min < 0 || min > 59 {
+		return 0, 0, fmt.Errorf("invalid daily reset time %q, expect HH:MM", resetTime)
+	}
+	return hour, min, nil
+}
+
+// recordsPruneInterval is how often the records that expired are removed from the sets tracking them.
+const recordsPruneInterval = time.Hour
+
+// StartRetentionSchedules starts the daily reset of every chat mode that has one configured, and the pruning
+// of the expired records of every chat mode whose records expire.
+func StartRetentionSchedules() error {
+	for _, mode := range []string{"private", "group"} {
+		policy := RetentionPolicyOf(mode)
+		if policy.IdleTTL > 0 {
+			go PruneRecordsPeriodically(mode)
+		}
+		if policy.DailyReset == "" {
+			continue
+		}
+		hour, min, err := parseResetTime(policy.DailyReset)
+		if err != nil {
+			return err
+		}
+		go DailyRecordsReset(mode, hour, min)
+	}
+	return nil
+}
+
+// DailyRecordsReset clears the conversation records of a chat mode every day at the given time.
+// Settings, usage and every key not written by StoreRecord are left untouched.
+func DailyRecordsReset(mode string, hour int, min int) {
+	t := time.NewTimer(SetTime(hour, min, 0))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			t.Reset(time.Hour * 24)
+			count, err := DeleteModeRecords(mode)
+			if err != nil {
+				logrus.Error("[Retention]reset "+mode+" records fail: ", err)
+				continue
+			}
+			logrus.Infof("[Retention]reset %d %s records", count, mode)
+		}
+	}
+}
+
+// PruneRecordsPeriodically removes the expired records of a chat mode from the set tracking them, so that the
+// set does not grow for good if there is no daily reset.
+func PruneRecordsPeriodically(mode string) {
+	ticker := time.NewTicker(recordsPruneInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		count, err := PruneModeRecords(mode)
+		if err != nil {
+			logrus.Error("[Retention]prune "+mode+" records fail: ", err)
+			continue
+		}
+		if count > 0 {
+			logrus.Infof("[Retention]pruned %d expired %s records", count, mode)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordRetention(t *testing.T) {
+	setTestConfig(t, &Config{ServeMode: "onebot", OneBot11: OneBot11Config{SelfId: 10000}, Retention: RetentionConfig{
+		Private: RetentionPolicy{IdleTTL: 60},
+		Group:   RetentionPolicy{IdleTTL: 3600},
+	}})
+	store := setTestStore(t)
+	group := ChatKey("group", "20002")
+	// a command changes the session before anybody has talked in it
+	err := UpdateRecord(group, func(record *Record) error {
+		record.Temperature = 0.5
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := RetrieveOrDefaultRecord(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Mode != "group" {
+		t.Errorf("mode = %q, want %q", record.Mode, "group")
+	}
+	recordKey := conversationRecordKey(group, 1)
+	if tracked, _ := store.SMembers(modeRecordsKey("group")); !ContainsString(tracked, recordKey) {
+		t.Errorf("%s is not tracked for the daily reset of group sessions", recordKey)
+	}
+	if ttl := store.store.entries[recordKey].ExpireAt; time.Until(ttl) < 59*time.Minute {
+		t.Errorf("record expires at %v, want the idle TTL of group sessions", ttl)
+	}
+
+	DeleteRecord(group)
+	if tracked, _ := store.SMembers(modeRecordsKey("group")); ContainsString(tracked, recordKey) {
+		t.Errorf("%s is still tracked after it was deleted", recordKey)
+	}
+
+	// an expired record is pruned from the set
+	if err = store.SAdd(modeRecordsKey("private"), conversationRecordKey(ChatKey("private", "10001"), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := PruneModeRecords("private"); err != nil || count != 1 {
+		t.Errorf("PruneModeRecords() = %d, %v, want 1, nil", count, err)
+	}
+}
+
+func TestDeleteModeRecordsDeletesIndexes(t *testing.T) {
+	setTestConfig(t, &Config{ServeMode: "onebot", OneBot11: OneBot11Config{SelfId: 10000}})
+	store := setTestStore(t)
+	private := ChatKey("private", "10001")
+	index := DefaultConversationIndex()
+	index.Add("第二个对话")
+	if err := StoreConversationIndex(private, index); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreRecord(private, NewRecord("")); err != nil {
+		t.Fatal(err)
+	}
+	count, err := DeleteModeRecords("private")
+	if err != nil || count != 1 {
+		t.Fatalf("DeleteModeRecords() = %d, %v, want 1, nil", count, err)
+	}
+	for _, key := range []string{conversationRecordKey(private, 2), private + ":conversations"} {
+		if exists, _ := store.Exists(key); exists {
+			t.Errorf("%s exists after the reset", key)
+		}
+	}
+}
@@ -17,6 +17,8 @@ type SendMsgData struct {
 	Message     []Message `json:"message"`
 	AutoEscape  bool      `json:"auto_escape"`
 	ReceivedMsg string    `json:"-"`
+	// AddressedToBot is true if the bot is expected to reply to the received message
+	AddressedToBot bool `json:"-"`
 }
 
 type Message struct {
@@ -24,6 +26,14 @@ type Message struct {
 	Data map[string]interface{} `json:"data" yaml:"data"`
 }
 
+// ChatGroupId returns the group the message was received in, or "" for private messages.
+func (data *SendMsgData) ChatGroupId() string {
+	if data.MessageType == "group" {
+		return data.GroupId
+	}
+	return ""
+}
+
 func (data *SendMsgData) Send() error {
 	var err error
 	if GlobalConfig.ServeMode == "onebot" {
@@ -31,6 +41,17 @@ func (data *SendMsgData) Send() error {
 	} else {
 		err = data.sendToOpenWechat()
 	}
+	event := AuditEvent{
+		Event:       "outbound",
+		MessageType: data.MessageType,
+		UserId:      data.UserId,
+		GroupId:     data.ChatGroupId(),
+		Text:        messageText(data.Message),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	Audit(event)
 	return err
 }
 
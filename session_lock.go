@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+type sessionLock struct {
+	waiters []chan struct{}
+}
+
+// KeyedMutex serializes work per key. Unlike sync.Mutex it hands the lock over in the order Lock was
+// called, so the messages of a session are processed in arrival order.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sessionLock
+}
+
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: make(map[string]*sessionLock)}
+}
+
+// SessionLocks serializes the processing of messages and commands of each chat session of this instance.
+// Use LockSession, which also serializes them across the instances sharing the storage.
+var SessionLocks = NewKeyedMutex()
+
+// Lock blocks until the lock of key is acquired and returns the function releasing it.
+func (m *KeyedMutex) Lock(key string) func() {
+	m.mu.Lock()
+	lock, held := m.locks[key]
+	if !held {
+		m.locks[key] = &sessionLock{}
+		m.mu.Unlock()
+		return func() { m.unlock(key) }
+	}
+	ready := make(chan struct{})
+	lock.waiters = append(lock.waiters, ready)
+	m.mu.Unlock()
+	<-ready
+	return func() { m.unlock(key) }
+}
+
+func (m *KeyedMutex) unlock(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lock := m.locks[key]
+	if len(lock.waiters) == 0 {
+		delete(m.locks, key)
+		return
+	}
+	// hand the lock over to the first waiter without releasing it
+	next := lock.waiters[0]
+	lock.waiters = lock.waiters[1:]
+	close(next)
+}
+
+const (
+	// sessionLeaseTTL bounds how long the session of a crashed instance stays locked
+	sessionLeaseTTL = 30 * time.Second
+	// sessionLeaseRenewal is how often a held lease is extended, e.g. while waiting for the AI
+	sessionLeaseRenewal = sessionLeaseTTL / 3
+	sessionLeaseMaxWait = 500 * time.Millisecond
+)
+
+var errLeaseLost = errors.New("session lease lost")
+
+// LockSession blocks until the session of key is locked on this instance and, if the storage is Redis, leased
+// in the storage, so that no instance sharing the storage works on the session meanwhile, and returns the
+// function releasing both. The lease expires if it is not renewed, so a crashed instance cannot lock a session
+// for good. The memory and file backends belong to a single process, so the local lock is enough there. If
+// the storage fails, the session is only locked on this instance.
+func LockSession(key string) func() {
+	unlock := SessionLocks.Lock(key)
+	if _, shared := Store.(*RedisStorage); !shared {
+		return unlock
+	}
+	leaseKey := key + ":lock"
+	tokenBytes := make([]byte, 16)
+	_, _ = rand.Read(tokenBytes)
+	token := hex.EncodeToString(tokenBytes)
+	wait := 10 * time.Millisecond
+	for {
+		acquired, err := Store.SetNX(leaseKey, token, sessionLeaseTTL)
+		if err != nil {
+			logrus.Error("lease session fail, locking it on this instance only: ", err)
+			return unlock
+		}
+		if acquired {
+			break
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > sessionLeaseMaxWait {
+			wait = sessionLeaseMaxWait
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(sessionLeaseRenewal)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := renewSessionLease(leaseKey, token)
+				if err == errLeaseLost {
+					logrus.Error("session lease lost: ", key)
+					return
+				} else if err != nil {
+					logrus.Error("renew session lease fail: ", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		if err := releaseSessionLease(leaseKey, token); err != nil && err != errLeaseLost {
+			logrus.Error("release session lease fail: ", err)
+		}
+		unlock()
+	}
+}
+
+// renewSessionLease extends the lease of key if it is still held with token.
+func renewSessionLease(leaseKey string, token string) error {
+	return updateSessionLease(leaseKey, token, func(pipe Storage) error {
+		return pipe.Expire(leaseKey, sessionLeaseTTL)
+	})
+}
+
+// releaseSessionLease deletes the lease of key if it is still held with token, and not by another instance
+// that took it over after it expired.
+func releaseSessionLease(leaseKey string, token string) error {
+	var err error
+	for i := 0; i < maxRecordUpdateRetries; i++ {
+		err = updateSessionLease(leaseKey, token, func(pipe Storage) error {
+			return pipe.Del(leaseKey)
+		})
+		if err != ErrTxConflict {
+			break
+		}
+	}
+	return err
+}
+
+func updateSessionLease(leaseKey string, token string, update func(pipe Storage) error) error {
+	return Store.Watch(func(tx Storage) error {
+		held, err := tx.Get(leaseKey)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		if held != token {
+			return errLeaseLost
+		}
+		return tx.Pipelined(update)
+	}, leaseKey)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+// SessionParams lists the parameters that can be changed with "NerdBot set <param> <value>".
+var SessionParams = []string{"model", "temperature", "top_p", "presence_penalty", "frequency_penalty", "max_tokens", "stop"}
+
+func (record *Record) EffectiveModel() string {
+	if record.Model != "" {
+		return record.Model
+	}
+	return GlobalConfig.AI.Model
+}
+
+func (record *Record) NewAIRequest() AIRequest {
+	return AIRequest{
+		Model:            record.EffectiveModel(),
+		Messages:         apiMessages(record.Messages),
+		Temperature:      record.Temperature,
+		TopP:             record.TopP,
+		PresencePenalty:  record.PresencePenalty,
+		FrequencyPenalty: record.FrequencyPenalty,
+		MaxTokens:        record.MaxTokens,
+		Stop:             record.Stop,
+	}
+}
+
+// apiMessages strips the record-only metadata from messages. Records stored before speakers were
+// attributed with the name field used the nickname as role, which is converted here.
+func apiMessages(messages []ChatMessage) []ChatMessage {
+	result := make([]ChatMessage, 0, len(messages))
+	for _, message := range messages {
+		message.UserId = ""
+		switch message.Role {
+		case "system", "user", "assistant":
+		default:
+			message.Name = SanitizeMessageName(message.Role)
+			message.Content = message.Role + ": " + message.Content
+			message.Role = "user"
+		}
+		result = append(result, message)
+	}
+	return result
+}
+
+// SetParam validates value and applies it to the record. The returned error is shown to the user.
+func (record *Record) SetParam(name string, value string) error {
+	value = strings.Trim(value, " ")
+	if value == "" {
+		return errors.New("参数值不能为空")
+	}
+	switch name {
+	case "model":
+		if value == "default" {
+			record.Model = ""
+			return nil
+		}
+		if !ContainsString(GlobalConfig.AI.AllowedModels, value) && value != GlobalConfig.AI.Model {
+			return fmt.Errorf("模型%s不在允许列表内，可选: %s", value, strings.Join(GlobalConfig.AI.AllowedModels, ", "))
+		}
+		record.Model = value
+	case "temperature":
+		temp, err := strconv.ParseFloat(value, 64)
+		if err != nil || temp < 0 || temp > 1 {
+			return errors.New("无效的temperature设置，值应该为0~1之间的小数")
+		}
+		record.Temperature = temp
+	case "top_p":
+		topP, err := strconv.ParseFloat(value, 64)
+		if err != nil || topP <= 0 || topP > 1 {
+			return errors.New("无效的top_p设置，值应该为0~1之间的小数且大于0")
+		}
+		record.TopP = topP
+	case "presence_penalty", "frequency_penalty":
+		penalty, err := strconv.ParseFloat(value, 64)
+		if err != nil || penalty < -2 || penalty > 2 {
+			return fmt.Errorf("无效的%s设置，值应该为-2~2之间的小数", name)
+		}
+		if name == "presence_penalty" {
+			record.PresencePenalty = penalty
+		} else {
+			record.FrequencyPenalty = penalty
+		}
+	case "max_tokens":
+		maxTokens, err := strconv.Atoi(value)
+		if err != nil || maxTokens < 0 || maxTokens > GlobalConfig.AI.ResponseMaxTokens {
+			return fmt.Errorf("无效的max_tokens设置，值应该为0~%d之间的整数，0表示使用模型默认值", GlobalConfig.AI.ResponseMaxTokens)
+		}
+		record.MaxTokens = maxTokens
+	case "stop":
+		if value == "none" {
+			record.Stop = nil
+			return nil
+		}
+		stop := strings.Split(value, "|")
+		if len(stop) > 4 {
+			return errors.New("无效的stop设置，最多支持4个停止词，以|分隔")
+		}
+		record.Stop = stop
+	default:
+		return fmt.Errorf("未知参数%s，可选: %s", name, strings.Join(SessionParams, ", "))
+	}
+	return nil
+}
+
+// SettingsText renders the effective parameters of the session for "NerdBot settings".
+func (record *Record) SettingsText() string {
+	orDefault := func(set bool, value string) string {
+		if !set {
+			return "默认"
+		}
+		return value
+	}
+	return "[通知]当前会话参数:" +
+		"\nmodel: " + record.EffectiveModel() +
+		"\ntemperature: " + strconv.FormatFloat(record.Temperature, 'f', -1, 64) +
+		"\ntop_p: " + orDefault(record.TopP != 0, strconv.FormatFloat(record.TopP, 'f', -1, 64)) +
+		"\npresence_penalty: " + strconv.FormatFloat(record.PresencePenalty, 'f', -1, 64) +
+		"\nfrequency_penalty: " + strconv.FormatFloat(record.FrequencyPenalty, 'f', -1, 64) +
+		"\nmax_tokens: " + orDefault(record.MaxTokens != 0, strconv.Itoa(record.MaxTokens)) +
+		"\nstop: " + orDefault(len(record.Stop) > 0, strings.Join(record.Stop, "|"))
+}
+
+// ExecuteSettingsCommand handles "NerdBot settings".
+func (req QQMessage) ExecuteSettingsCommand(idStr string) string {
+	record, err := RetrieveOrDefaultRecord(idStr)
+	if err != nil {
+		logrus.Error(err)
+		return "[错误]获取会话参数失败:获取记录失败"
+	}
+	return record.SettingsText()
+}
+
+// ExecuteSetCommand handles "NerdBot set <param> <value>". Non-admins may only set the params listed in
+// userSettableParams.
+func (req QQMessage) ExecuteSetCommand(name string, value string, idStr string, isAdmin bool) string {
+	if !isAdmin && !ContainsString(GlobalConfig.AI.UserSettableParams, name) {
+		return "[错误]\n对不起，您没有权限执行该命令"
+	}
+	var paramErr error
+	err := UpdateRecord(idStr, func(record *Record) error {
+		paramErr = record.SetParam(name, value)
+		return paramErr
+	})
+	if paramErr != nil {
+		logrus.Error("invalid session param setting: ", name, " ", value)
+		return "[错误]" + paramErr.Error()
+	}
+	if err != nil {
+		logrus.Error(err)
+		return fmt.Sprintf("[错误]%s参数设置失败：存储记录失败", name)
+	}
+	return fmt.Sprintf("[通知]新的%s参数已生效: %s", name, strings.Trim(value, " "))
+}
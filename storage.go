@@ -0,0 +1,604 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage is where NerdBot keeps its state. It follows the data model of Redis: strings, hashes, sets and
+// sorted sets stored under string keys, each of which may expire.
+type Storage interface {
+	// Get returns ErrKeyNotFound if key does not exist.
+	Get(key string) (string, error)
+	Set(key string, value string, ttl time.Duration) error
+	SetNX(key string, value string, ttl time.Duration) (bool, error)
+	Del(keys ...string) error
+	Exists(key string) (bool, error)
+	Rename(key string, newKey string) error
+	RenameNX(key string, newKey string) (bool, error)
+	Expire(key string, ttl time.Duration) error
+	// Scan returns the keys matching a glob pattern.
+	Scan(pattern string) ([]string, error)
+
+	HSet(key string, values map[string]string) error
+	HGetAll(key string) (map[string]string, error)
+	HDel(key string, fields ...string) error
+	HLen(key string) (int64, error)
+	HExists(key string, field string) (bool, error)
+	HIncrBy(key string, field string, incr int64) error
+	HIncrByFloat(key string, field string, incr float64) error
+
+	SAdd(key string, members ...string) error
+	SRem(key string, members ...string) error
+	SIsMember(key string, member string) (bool, error)
+	SMembers(key string) ([]string, error)
+
+	ZIncrBy(key string, member string, incr float64) error
+	// ZRevRange returns the n members with the highest scores.
+	ZRevRange(key string, n int64) ([]ScoredMember, error)
+
+	// Pipelined runs the writes of fn as one transaction. Reads inside fn are not supported.
+	Pipelined(fn func(pipe Storage) error) error
+	// Watch runs fn, whose transaction started with Pipelined fails with ErrTxConflict if one of the watched
+	// keys is modified by someone else in the meantime.
+	Watch(fn func(tx Storage) error, keys ...string) error
+	// Publish sends message to the subscribers of channel on every instance sharing the storage.
+	Publish(channel string, message string) error
+	// Subscribe calls handler with every message published to channel.
+	Subscribe(channel string, handler func(message string)) error
+	// TakeTokens atomically takes one token from each token bucket, see TakeRateLimitTokens.
+	TakeTokens(keys []string, limits []BucketLimit, now time.Time) (int, time.Duration, error)
+	Close() error
+}
+
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+var (
+	ErrKeyNotFound = errors.New("storage: key not found")
+	ErrTxConflict  = errors.New("storage: transaction failed, watched key changed")
+	ErrWrongType   = errors.New("storage: operation against a key holding the wrong kind of value")
+)
+
+var Store Storage
+
+// InitStorage opens the configured storage backend.
+func InitStorage() error {
+	var err error
+	switch GlobalConfig.Storage.Backend {
+	case "redis", "":
+		Store, err = NewRedisStorage(GlobalConfig.Redis)
+	case "memory":
+		Store = NewMemoryStorage()
+	case "file":
+		Store, err = NewFileStorage(GlobalConfig.Storage.File)
+	default:
+		err = fmt.Errorf("unknown storage backend %q", GlobalConfig.Storage.Backend)
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Info("initiate storage success: ", GlobalConfig.Storage.Backend)
+	return nil
+}
+
+// maxRecordUpdateRetries is the number of times UpdateRecord retries when the record was changed concurrently.
+const maxRecordUpdateRetries = 10
+
+// ErrRecordConflict is returned by UpdateRecord if the record kept changing concurrently.
+var ErrRecordConflict = errors.New("record changed concurrently")
+
+// StoreRecord stores the record of the active conversation of the chat identified by key.
+func StoreRecord(key string, record *Record) error {
+	recordKey, err := activeRecordKey(key)
+	if err != nil {
+		return err
+	}
+	return Store.Pipelined(func(pipe Storage) error {
+		return storeRecordTo(pipe, recordKey, record)
+	})
+}
+
+// UpdateRecord applies update to the record of the active conversation of the chat identified by key.
+// The record is watched while it is updated, so that changes of other handlers or instances are never
+// overwritten: if it changes in between, update is applied again to the new record.
+// An error returned by update aborts the update and is returned as is.
+func UpdateRecord(key string, update func(record *Record) error) error {
+	recordKey, err := activeRecordKey(key)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < maxRecordUpdateRetries; i++ {
+		err = Store.Watch(func(tx Storage) error {
+			record, err := loadRecord(tx, key, recordKey)
+			if err != nil {
+				return err
+			}
+			err = update(record)
+			if err != nil {
+				return err
+			}
+			return tx.Pipelined(func(pipe Storage) error {
+				return storeRecordTo(pipe, recordKey, record)
+			})
+		}, recordKey)
+		if err != ErrTxConflict {
+			return err
+		}
+	}
+	return ErrRecordConflict
+}
+
+// storeRecordTo writes record to pipe.
+func storeRecordTo(pipe Storage, recordKey string, record *Record) error {
+	// Convert the Record struct to JSON
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// Store the JSON, expiring after the idle TTL of its chat mode
+	mode := record.Mode
+	if mode == "" {
+		mode = modeOfChatKey(chatKeyOfRecordKey(recordKey))
+	}
+	ttl := RetentionPolicyOf(mode).IdleExpiration()
+	err = pipe.Set(recordKey, string(recordJSON), ttl)
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		// the conversation index lives as long as the last used conversation of the chat
+		err = pipe.Expire(chatKeyOfRecordKey(recordKey)+":conversations", ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return pipe.SAdd(modeRecordsKey(mode), recordKey)
+}
+
+// modeOfChatKey returns the chat mode of a key made by ChatKey.
+func modeOfChatKey(key string) string {
+	if _, ok := groupIdOfChatKey(key); ok {
+		return "group"
+	}
+	return "private"
+}
+
+// chatKeyOfRecordKey returns the key of the chat a record key made by conversationRecordKey belongs to.
+func chatKeyOfRecordKey(recordKey string) string {
+	if i := strings.LastIndex(recordKey, ":record"); i >= 0 {
+		return recordKey[:i]
+	}
+	return recordKey
+}
+
+// modeRecordsKey returns the key of the set tracking the records of a chat mode for the daily reset.
+func modeRecordsKey(mode string) string {
+	return Key("records", mode)
+}
+
+// DeleteModeRecords deletes every record stored in a chat mode, together with the conversation indexes of
+// their chats, and returns their number.
+func DeleteModeRecords(mode string) (int, error) {
+	resetKey := modeRecordsKey(mode) + ":resetting"
+	exists, err := Store.Exists(modeRecordsKey(mode))
+	if err != nil || !exists {
+		return 0, err
+	}
+	// rename first, so records stored during the reset are tracked for the next one
+	err = Store.Rename(modeRecordsKey(mode), resetKey)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := Store.SMembers(resetKey)
+	if err != nil {
+		return 0, err
+	}
+	indexes := make(map[string]bool)
+	for _, key := range keys {
+		indexes[chatKeyOfRecordKey(key)+":conversations"] = true
+	}
+	for index := range indexes {
+		keys = append(keys, index)
+	}
+	for start := 0; start < len(keys); start += 100 {
+		end := start + 100
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err = Store.Del(keys[start:end]...)
+		if err != nil {
+			return start, err
+		}
+	}
+	return len(keys) - len(indexes), Store.Del(resetKey)
+}
+
+// PruneModeRecords removes the records that have expired from the set tracking the records of a chat mode
+// and returns their number.
+func PruneModeRecords(mode string) (int, error) {
+	keys, err := Store.SMembers(modeRecordsKey(mode))
+	if err != nil {
+		return 0, err
+	}
+	var expired []string
+	for _, key := range keys {
+		exists, err := Store.Exists(key)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			expired = append(expired, key)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	return len(expired), Store.SRem(modeRecordsKey(mode), expired...)
+}
+
+// RetrieveOrDefaultRecord returns the record of the active conversation of the chat identified by key.
+func RetrieveOrDefaultRecord(key string) (*Record, error) {
+	recordKey, err := activeRecordKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return loadRecord(Store, key, recordKey)
+}
+
+func loadRecord(store Storage, key string, recordKey string) (*Record, error) {
+	// Get the stored JSON
+	recordJSON, err := store.Get(recordKey)
+	if err == ErrKeyNotFound {
+		personaName, err := GetChatPersona(key)
+		if err != nil {
+			return nil, err
+		}
+		record := NewRecord(personaName)
+		// a record first saved by a command keeps the retention policy of its chat
+		record.Mode = modeOfChatKey(key)
+		return record, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// Convert the JSON to a Record struct
+	var record Record
+	err = json.Unmarshal([]byte(recordJSON), &record)
+	if err != nil {
+		return nil, err
+	}
+	if record.Mode == "" {
+		record.Mode = modeOfChatKey(key)
+	}
+	return &record, err
+}
+
+// DeleteRecord clears the active conversation of the chat identified by key.
+func DeleteRecord(key string) {
+	recordKey, err := activeRecordKey(key)
+	if err == nil {
+		err = deleteRecordKey(key, recordKey)
+	}
+	if err != nil {
+		logrus.Error("delete record fail: ", err)
+	}
+}
+
+// deleteRecordKey deletes a record of the chat identified by key and stops tracking it for the daily reset.
+func deleteRecordKey(key string, recordKey string) error {
+	return Store.Pipelined(func(pipe Storage) error {
+		if err := pipe.Del(recordKey); err != nil {
+			return err
+		}
+		return pipe.SRem(modeRecordsKey(modeOfChatKey(key)), recordKey)
+	})
+}
+
+// conversationRecordKey returns the key of a conversation's record in the chat identified by key.
+func conversationRecordKey(key string, conversationId int) string {
+	if conversationId <= 1 {
+		return key + ":record"
+	}
+	return key + ":record:" + strconv.Itoa(conversationId)
+}
+
+func activeRecordKey(key string) (string, error) {
+	index, err := RetrieveConversationIndex(key)
+	if err != nil {
+		return "", err
+	}
+	return conversationRecordKey(key, index.Active), nil
+}
+
+func RetrieveConversationIndex(key string) (*ConversationIndex, error) {
+	indexJSON, err := Store.Get(key + ":conversations")
+	if err == ErrKeyNotFound {
+		return DefaultConversationIndex(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	var index ConversationIndex
+	err = json.Unmarshal([]byte(indexJSON), &index)
+	if err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func StoreConversationIndex(key string, index *ConversationIndex) error {
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return Store.Set(key+":conversations", string(indexJSON), RetentionPolicyOf(modeOfChatKey(key)).IdleExpiration())
+}
+
+// StoreConversationRecord saves the record of a conversation that may not be the active one.
+func StoreConversationRecord(key string, conversationId int, record *Record) error {
+	return Store.Pipelined(func(pipe Storage) error {
+		return storeRecordTo(pipe, conversationRecordKey(key, conversationId), record)
+	})
+}
+
+// DeleteConversationRecord removes the record of a conversation that may not be the active one.
+func DeleteConversationRecord(key string, conversationId int) error {
+	return deleteRecordKey(key, conversationRecordKey(key, conversationId))
+}
+
+// StorePersona saves a persona edited at runtime. It takes precedence over the one in config.yaml.
+func StorePersona(name string, persona Persona) error {
+	personaJSON, err := json.Marshal(persona)
+	if err != nil {
+		return err
+	}
+	return Store.HSet(Key("personas"), map[string]string{name: string(personaJSON)})
+}
+
+func DeletePersona(name string) error {
+	return Store.HDel(Key("personas"), name)
+}
+
+// RetrieveRuntimePersonas returns the personas edited at runtime.
+func RetrieveRuntimePersonas() (map[string]Persona, error) {
+	values, err := Store.HGetAll(Key("personas"))
+	if err != nil {
+		return nil, err
+	}
+	personas := make(map[string]Persona, len(values))
+	for name, value := range values {
+		var persona Persona
+		err = json.Unmarshal([]byte(value), &persona)
+		if err != nil {
+			return nil, err
+		}
+		personas[name] = persona
+	}
+	return personas, nil
+}
+
+// SetChatPersona sets the default persona of a user or group. An empty name restores InitialPrompts.
+// The persona of a group session is kept in the settings of the group.
+func SetChatPersona(key string, name string) error {
+	if groupId, ok := groupIdOfChatKey(key); ok {
+		return UpdateGroupSettings(groupId, func(settings *GroupSettings) error {
+			settings.Persona = name
+			return nil
+		})
+	}
+	if name == "" {
+		return Store.Del(key + ":persona")
+	}
+	return Store.Set(key+":persona", name, 0)
+}
+
+func GetChatPersona(key string) (string, error) {
+	if groupId, ok := groupIdOfChatKey(key); ok {
+		settings, err := GetGroupSettings(groupId)
+		return settings.Persona, err
+	}
+	name, err := Store.Get(key + ":persona")
+	if err == ErrKeyNotFound {
+		return "", nil
+	}
+	return name, err
+}
+
+// GetCachedResponse returns the cached answer stored under key, or "" if there is none.
+func GetCachedResponse(key string) (string, error) {
+	answer, err := Store.Get(key)
+	if err == ErrKeyNotFound {
+		return "", nil
+	}
+	return answer, err
+}
+
+func StoreCachedResponse(key string, answer string, ttl time.Duration) error {
+	return Store.Set(key, answer, ttl)
+}
+
+// RetrieveCacheEmbeddings returns the embeddings of an index, keyed by the cache key of their answer.
+func RetrieveCacheEmbeddings(indexKey string) (map[string][]float64, error) {
+	values, err := Store.HGetAll(indexKey)
+	if err != nil {
+		return nil, err
+	}
+	embeddings := make(map[string][]float64, len(values))
+	for key, value := range values {
+		var embedding []float64
+		err = json.Unmarshal([]byte(value), &embedding)
+		if err != nil {
+			return nil, err
+		}
+		embeddings[key] = embedding
+	}
+	return embeddings, nil
+}
+
+// StoreCacheEmbedding adds an embedding to an index unless the index already holds maxEntries.
+func StoreCacheEmbedding(indexKey string, key string, embedding []float64, maxEntries int64, ttl time.Duration) error {
+	count, err := Store.HLen(indexKey)
+	if err != nil {
+		return err
+	}
+	if count >= maxEntries {
+		return nil
+	}
+	embeddingJSON, err := json.Marshal(embedding)
+	if err != nil {
+		return err
+	}
+	err = Store.HSet(indexKey, map[string]string{key: string(embeddingJSON)})
+	if err != nil {
+		return err
+	}
+	return Store.Expire(indexKey, ttl)
+}
+
+func DeleteCacheEmbedding(indexKey string, key string) error {
+	return Store.HDel(indexKey, key)
+}
+
+func knowledgeKey(groupId string) string {
+	return Key("kb", groupId)
+}
+
+// StoreKnowledgeChunks adds chunks to the knowledge base of a group, replacing those with the same id.
+func StoreKnowledgeChunks(groupId string, chunks []KnowledgeChunk) error {
+	values := make(map[string]string, len(chunks))
+	for _, chunk := range chunks {
+		chunkJSON, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		values[chunk.Id] = string(chunkJSON)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return Store.HSet(knowledgeKey(groupId), values)
+}
+
+func RetrieveKnowledgeChunks(groupId string) ([]KnowledgeChunk, error) {
+	values, err := Store.HGetAll(knowledgeKey(groupId))
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]KnowledgeChunk, 0, len(values))
+	for _, value := range values {
+		var chunk KnowledgeChunk
+		err = json.Unmarshal([]byte(value), &chunk)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+func KnowledgeChunkExists(groupId string, chunkId string) (bool, error) {
+	return Store.HExists(knowledgeKey(groupId), chunkId)
+}
+
+func CountKnowledgeChunks(groupId string) (int64, error) {
+	return Store.HLen(knowledgeKey(groupId))
+}
+
+func DeleteKnowledgeBase(groupId string) error {
+	return Store.Del(knowledgeKey(groupId))
+}
+
+// usageKey returns the key of the usage counters of a scope ("user", "group" or "global") in a period.
+func usageKey(period string, scope string, id string) string {
+	if scope == "global" {
+		return Key("usage", period, "global")
+	}
+	return Key("usage", period, scope, id)
+}
+
+// usageRankKey returns the key of the sorted set ranking the users or groups of a period by tokens.
+// With a groupId it ranks the members of that group.
+func usageRankKey(period string, scope string, groupId string) string {
+	if groupId != "" {
+		return Key("usage", period, "rank", "group", groupId)
+	}
+	return Key("usage", period, "rank", scope)
+}
+
+// IncrUsage adds one AI request to the usage counters of the user, the group and the whole bot in every period.
+func IncrUsage(periods []string, userId string, groupId string, entry UsageEntry, ttl time.Duration) error {
+	total := float64(entry.PromptTokens + entry.CompletionTokens)
+	return Store.Pipelined(func(pipe Storage) error {
+		for _, period := range periods {
+			keys := []string{usageKey(period, "user", userId), usageKey(period, "global", "")}
+			rankKeys := map[string]string{usageRankKey(period, "user", ""): userId}
+			if groupId != "" {
+				keys = append(keys, usageKey(period, "group", groupId))
+				rankKeys[usageRankKey(period, "group", "")] = groupId
+				rankKeys[usageRankKey(period, "group", groupId)] = userId
+			}
+			for _, key := range keys {
+				errs := []error{
+					pipe.HIncrBy(key, "requests", 1),
+					pipe.HIncrBy(key, "prompt", int64(entry.PromptTokens)),
+					pipe.HIncrBy(key, "completion", int64(entry.CompletionTokens)),
+					pipe.HIncrByFloat(key, "cost", entry.Cost),
+					pipe.HIncrBy(key, "model:"+entry.Model+":prompt", int64(entry.PromptTokens)),
+					pipe.HIncrBy(key, "model:"+entry.Model+":completion", int64(entry.CompletionTokens)),
+					pipe.Expire(key, ttl),
+				}
+				for _, err := range errs {
+					if err != nil {
+						return err
+					}
+				}
+			}
+			for key, member := range rankKeys {
+				err := pipe.ZIncrBy(key, member, total)
+				if err == nil {
+					err = pipe.Expire(key, ttl)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func RetrieveUsage(period string, scope string, id string) (map[string]string, error) {
+	return Store.HGetAll(usageKey(period, scope, id))
+}
+
+// RetrieveUsageRank returns the top n members of a usage ranking with their token counts.
+func RetrieveUsageRank(period string, scope string, groupId string, n int64) ([]ScoredMember, error) {
+	return Store.ZRevRange(usageRankKey(period, scope, groupId), n)
+}
+
+// rateLimitKey returns the key of the token bucket of a scope ("user", "group" or "global").
+func rateLimitKey(scope string, id string) string {
+	if scope == "global" {
+		return Key("ratelimit", "global")
+	}
+	return Key("ratelimit", scope, id)
+}
+
+// TakeRateLimitTokens atomically takes one token from each bucket. If a bucket is empty, nothing is taken
+// and the index of that bucket is returned together with the time until it refills.
+func TakeRateLimitTokens(keys []string, limits []BucketLimit) (int, time.Duration, error) {
+	return Store.TakeTokens(keys, limits, time.Now())
+}
+
+// MarkRateLimitWarned records that the user was warned about an empty bucket. It returns false if the user
+// was already warned within the current window.
+func MarkRateLimitWarned(key string, userId string, window time.Duration) (bool, error) {
+	return Store.SetNX(key+":warned:"+userId, "1", window)
+}
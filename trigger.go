@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// compiledTriggers caches the compiled regular expressions of the AI triggers by pattern.
+var compiledTriggers sync.Map
+
+func compileTrigger(pattern string) (*regexp.Regexp, error) {
+	if re, ok := compiledTriggers.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compiledTriggers.Store(pattern, re)
+	return re, nil
+}
+
+// expandCommandPrefix replaces {nickname} in a configured command prefix by the bot's nickname and reports
+// whether it did. A prefix with {nickname} is dropped if the nickname is not configured.
+func expandCommandPrefix(prefix string) (string, bool, bool) {
+	if !strings.Contains(prefix, "{nickname}") {
+		return prefix, false, true
+	}
+	if GlobalConfig.OneBot11.SelfNickname == "" {
+		return "", true, false
+	}
+	return strings.ReplaceAll(prefix, "{nickname}", GlobalConfig.OneBot11.SelfNickname), true, true
+}
+
+// commandPrefixes returns the configured command prefixes with {nickname} replaced by the bot's nickname.
+func commandPrefixes() []string {
+	prefixes := make([]string, 0, len(GlobalConfig.Command.Prefixes))
+	for _, prefix := range GlobalConfig.Command.Prefixes {
+		if prefix, _, ok := expandCommandPrefix(prefix); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// ParseCommand returns the command of a message starting with one of the command prefixes, e.g. "/清除"
+// gives "清除". Messages starting with the bot's
+// nickname are commands only if a registered command follows, otherwise they are talking to the bot.
+func ParseCommand(rawMessage string) (string, bool) {
+	for _, prefix := range GlobalConfig.Command.Prefixes {
+		prefix, byName, ok := expandCommandPrefix(prefix)
+		if !ok || prefix == "" || !strings.HasPrefix(rawMessage, prefix) {
+			continue
+		}
+		command := strings.Trim(strings.TrimPrefix(rawMessage, prefix), " ")
+		if command == "" {
+			continue
+		}
+		if byName {
+			if c, _ := FindCommand(command); c == nil {
+				continue
+			}
+		}
+		return command, true
+	}
+	return "", false
+}
+
+// Triggered reports whether a group message addresses the bot without an @, by the bot's name or by one of
+// the trigger patterns of the config or of the group.
+func (req QQMessage) Triggered(text string) bool {
+	nickname := GlobalConfig.OneBot11.SelfNickname
+	if GlobalConfig.Command.TriggerOnName && nickname != "" &&
+		strings.Contains(strings.ToLower(text), strings.ToLower(nickname)) {
+		return true
+	}
+	patterns := GlobalConfig.Command.Triggers
+	if req.MessageType == "group" {
+		patterns = append(patterns[:len(patterns):len(patterns)], GroupSettingsOrDefault(req.GroupId).Triggers...)
+	}
+	for _, pattern := range patterns {
+		re, err := compileTrigger(pattern)
+		if err != nil {
+			logrus.Errorf("invalid trigger %q: %s", pattern, err)
+			continue
+		}
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usageRankSize is the number of entries shown by "NerdBot usage top" and the group breakdown.
+const usageRankSize = 10
+
+type UsageEntry struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+}
+
+type ModelUsage struct {
+	PromptTokens     int64
+	CompletionTokens int64
+}
+
+type UsageStat struct {
+	Requests         int64
+	PromptTokens     int64
+	CompletionTokens int64
+	Cost             float64
+	Models           map[string]*ModelUsage
+}
+
+func (stat UsageStat) TotalTokens() int64 {
+	return stat.PromptTokens + stat.CompletionTokens
+}
+
+func DayPeriod(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func MonthPeriod(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+// EstimateCost computes the cost of a request from the price table. Unknown models cost nothing.
+func EstimateCost(model string, promptTokens int, completionTokens int) float64 {
+	price, ok := GlobalConfig.Usage.Prices[model]
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1000
+}
+
+// RecordUsage adds the tokens of an AI response to the daily and monthly usage of the user and group.
+// model is the requested model, which unlike resp.Model matches the price table.
+func RecordUsage(userId string, groupId string, model string, resp AIResponse) {
+	entry := UsageEntry{
+		Model:            model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}
+	if entry.PromptTokens == 0 && entry.CompletionTokens == 0 {
+		return
+	}
+	entry.Cost = EstimateCost(entry.Model, entry.PromptTokens, entry.CompletionTokens)
+	now := time.Now()
+	ttl := time.Duration(GlobalConfig.Usage.RetentionDays) * 24 * time.Hour
+	err := IncrUsage([]string{DayPeriod(now), MonthPeriod(now)}, userId, groupId, entry, ttl)
+	if err != nil {
+		logrus.Error("record usage fail: ", err)
+	}
+}
+
+func GetUsage(period string, scope string, id string) (UsageStat, error) {
+	values, err := RetrieveUsage(period, scope, id)
+	if err != nil {
+		return UsageStat{}, err
+	}
+	stat := UsageStat{Models: make(map[string]*ModelUsage)}
+	for field, value := range values {
+		switch field {
+		case "requests":
+			stat.Requests, _ = strconv.ParseInt(value, 10, 64)
+		case "prompt":
+			stat.PromptTokens, _ = strconv.ParseInt(value, 10, 64)
+		case "completion":
+			stat.CompletionTokens, _ = strconv.ParseInt(value, 10, 64)
+		case "cost":
+			stat.Cost, _ = strconv.ParseFloat(value, 64)
+		default:
+			// per model fields are "model:<name>:prompt" and "model:<name>:completion"
+			sep := strings.LastIndex(field, ":")
+			if !strings.HasPrefix(field, "model:") || sep < len("model:") {
+				continue
+			}
+			model := field[len("model:"):sep]
+			if stat.Models[model] == nil {
+				stat.Models[model] = &ModelUsage{}
+			}
+			tokens, _ := strconv.ParseInt(value, 10, 64)
+			if field[sep+1:] == "prompt" {
+				stat.Models[model].PromptTokens = tokens
+			} else {
+				stat.Models[model].CompletionTokens = tokens
+			}
+		}
+	}
+	return stat, nil
+}
+
+func (stat UsageStat) Text(title string) string {
+	text := fmt.Sprintf("%s: %d次请求, prompt %d + completion %d = %d tokens, 约%.4f %s",
+		title, stat.Requests, stat.PromptTokens, stat.CompletionTokens, stat.TotalTokens(), stat.Cost, GlobalConfig.Usage.Currency)
+	models := make([]string, 0, len(stat.Models))
+	for model := range stat.Models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	for _, model := range models {
+		text += fmt.Sprintf("\n  %s: %d + %d tokens", model, stat.Models[model].PromptTokens, stat.Models[model].CompletionTokens)
+	}
+	return text
+}
+
+func usageSummary(title string, scope string, id string) (string, error) {
+	now := time.Now()
+	today, err := GetUsage(DayPeriod(now), scope, id)
+	if err != nil {
+		return "", err
+	}
+	month, err := GetUsage(MonthPeriod(now), scope, id)
+	if err != nil {
+		return "", err
+	}
+	return "[通知]" + title + "的用量\n" + today.Text("今日") + "\n" + month.Text("本月"), nil
+}
+
+func usageRankText(title string, period string, scope string, groupId string) (string, error) {
+	rank, err := RetrieveUsageRank(period, scope, groupId, usageRankSize)
+	if err != nil {
+		return "", err
+	}
+	text := title
+	if len(rank) == 0 {
+		return text + "\n暂无数据", nil
+	}
+	for i, z := range rank {
+		text += fmt.Sprintf("\n%d. %s: %d tokens", i+1, z.Member, int64(z.Score))
+	}
+	return text, nil
+}
+
+// ExecuteUsageCommand handles "NerdBot usage", "NerdBot usage top [month]" and "NerdBot usage group [groupId]".
+func (req QQMessage) ExecuteUsageCommand(fields []string, isAdmin bool) string {
+	if len(fields) == 0 {
+		text, err := usageSummary("您", "user", strconv.FormatInt(req.UserId, 10))
+		if err != nil {
+			logrus.Error("get usage fail: ", err)
+			return "[错误]获取用量失败"
+		}
+		return text
+	}
+	if !isAdmin {
+		return "[错误]\n对不起，您没有权限执行该命令"
+	}
+	now := time.Now()
+	period, periodName := DayPeriod(now), "今日"
+	if len(fields) > 1 && fields[len(fields)-1] == "month" {
+		period, periodName = MonthPeriod(now), "本月"
+		fields = fields[:len(fields)-1]
+	}
+	switch fields[0] {
+	case "top":
+		users, err := usageRankText("[通知]"+periodName+"用户用量排行", period, "user", "")
+		if err != nil {
+			logrus.Error("get usage rank fail: ", err)
+			return "[错误]获取用量排行失败"
+		}
+		groups, err := usageRankText(periodName+"群用量排行", period, "group", "")
+		if err != nil {
+			logrus.Error("get usage rank fail: ", err)
+			return "[错误]获取用量排行失败"
+		}
+		global, err := GetUsage(period, "global", "")
+		if err != nil {
+			logrus.Error("get usage fail: ", err)
+			return "[错误]获取用量失败"
+		}
+		return users + "\n" + groups + "\n" + global.Text(periodName+"总计")
+	case "group":
+		groupId := strconv.FormatInt(req.GroupId, 10)
+		if len(fields) > 1 {
+			groupId = fields[1]
+		} else if req.MessageType != "group" {
+			return "[错误]用法: NerdBot usage group [群号] [month]"
+		}
+		stat, err := GetUsage(period, "group", groupId)
+		if err != nil {
+			logrus.Error("get usage fail: ", err)
+			return "[错误]获取用量失败"
+		}
+		members, err := usageRankText(periodName+"成员用量排行", period, "group", groupId)
+		if err != nil {
+			logrus.Error("get usage rank fail: ", err)
+			return "[错误]获取用量排行失败"
+		}
+		return "[通知]群" + groupId + "的用量\n" + stat.Text(periodName) + "\n" + members
+	}
+	return "[错误]未查询到相应指令，可用: usage|usage top [month]|usage group [群号] [month]"
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"regexp"
 	"strconv"
 	"strings"
@@ -48,6 +50,7 @@ func ParseCQCode(cqCode string) ([]Message, string, ReceivedCQTypes) {
 				types.hasJson = true
 			} else if message.Type == "reply" {
 				types.hasReply = true
+				types.replyId, _ = message.Data["id"].(string)
 			} else if message.Type == "face" {
 				types.hasFace = true
 			} else if message.Type == "Image" {
@@ -61,3 +64,41 @@ func ParseCQCode(cqCode string) ([]Message, string, ReceivedCQTypes) {
 	}
 	return nil, cqCode, types
 }
+
+func IsAdmin(userId int64) bool {
+	for _, id := range GlobalConfig.Server.AdminIds {
+		if userId == id {
+			return true
+		}
+	}
+	return false
+}
+
+func ContainsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// messageNamePattern is the charset of the name field of chat messages.
+var messageNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// SanitizeMessageName converts a nickname to the name field of chat messages. A nickname outside the allowed
+// charset, e.g. a Chinese one, is replaced by a short hash of it, so that speakers stay apart without sending
+// their ids to the API.
+func SanitizeMessageName(nickname string) string {
+	name := strings.ReplaceAll(strings.TrimSpace(nickname), " ", "_")
+	if name == "" || messageNamePattern.MatchString(name) {
+		return name
+	}
+	hash := sha256.Sum256([]byte(nickname))
+	return "u_" + hex.EncodeToString(hash[:4])
+}
+
+// UnescapeCQ reverts the escaping of special characters in the raw message of OneBot.
+func UnescapeCQ(text string) string {
+	return strings.NewReplacer("&#91;", "[", "&#93;", "]", "&#44;", ",", "&amp;", "&").Replace(text)
+}
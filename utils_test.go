@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSanitizeMessageName(t *testing.T) {
+	tests := []struct {
+		nickname string
+		want     string
+	}{
+		{"Alice", "Alice"},
+		{"bob_1-2", "bob_1-2"},
+		{" Big Bob ", "Big_Bob"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := SanitizeMessageName(tt.nickname); got != tt.want {
+			t.Errorf("SanitizeMessageName(%q) = %q, want %q", tt.nickname, got, tt.want)
+		}
+	}
+	for _, nickname := range []string{"小明", "小明abc", "a.b", string(make([]byte, 65))} {
+		name := SanitizeMessageName(nickname)
+		if !messageNamePattern.MatchString(name) {
+			t.Errorf("SanitizeMessageName(%q) = %q, not a valid name", nickname, name)
+		}
+		if name != SanitizeMessageName(nickname) {
+			t.Errorf("SanitizeMessageName(%q) is not stable", nickname)
+		}
+	}
+	if SanitizeMessageName("小明") == SanitizeMessageName("小红") {
+		t.Error("different nicknames share a name")
+	}
+}